@@ -6,6 +6,8 @@ require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/google/gopacket v1.1.19
 	go.etcd.io/bbolt v1.4.2
+	golang.org/x/crypto v0.32.0
+	golang.org/x/net v0.21.0
+	golang.org/x/sys v0.29.0
+	golang.org/x/term v0.28.0
 )
-
-require golang.org/x/sys v0.29.0 // indirect
@@ -1,14 +1,58 @@
-
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 )
 
+// getAgentID returns the agent ID stored in kk.toml. On first use the ID
+// older versions derived from the MAC address is stored, so that upgraded
+// devices keep the identity the server knows them by and no longer depend
+// on the network interfaces afterwards. Devices without a usable interface
+// get a random ID.
 func getAgentID() (uint64, error) {
+	cfg, err := loadClientConfig()
+	if err != nil {
+		return 0, err
+	}
+	if cfg.AgentID != "" {
+		return strconv.ParseUint(cfg.AgentID, 10, 64)
+	}
+
+	agentID, err := legacyAgentID()
+	if err != nil {
+		if agentID, err = newAgentID(); err != nil {
+			return 0, err
+		}
+	}
+	cfg.AgentID = strconv.FormatUint(agentID, 10)
+	if _, err := cfg.save(); err != nil {
+		return 0, err
+	}
+	return agentID, nil
+}
+
+// newAgentID generates a random non-zero agent ID.
+func newAgentID() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// legacyAgentID returns the ID older versions of kk derived from the hardware
+// address of the first interface that is up. It is only used to migrate
+// existing agents.
+func legacyAgentID() (uint64, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return 0, err
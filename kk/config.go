@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// clientConfig is the kk client configuration stored in kk.toml.
+type clientConfig struct {
+	AgentID      string `toml:"agent_id,omitempty"`       // decimal, random unless enrolled with -id or -ed25519
+	AgentName    string `toml:"agent_name,omitempty"`     // optional human-readable name
+	AgentKey     string `toml:"agent_key,omitempty"`      // base64 per-agent key
+	SignKey      string `toml:"sign_key,omitempty"`       // base64 Ed25519 private key seed
+	AgentKeyName string `toml:"agent_key_name,omitempty"` // keystore name of the per-agent key, instead of agent_key
+	SignKeyName  string `toml:"sign_key_name,omitempty"`  // keystore name of the Ed25519 seed, instead of sign_key
+	Salt         string `toml:"salt,omitempty"`           // base64 salt for passphrase-derived keys
+	KeyID        uint32 `toml:"key_id,omitempty"`         // server key ring ID of the master key
+
+	ServerKey string `toml:"server_key,omitempty"` // base64 X25519 or hybrid public key of the server
+	ServerID  string `toml:"server_id,omitempty"`  // identity the knocks are bound to
+	Source    string `toml:"source,omitempty"`     // address to be granted, or "packet" behind NAT
+	UDPPort   int    `toml:"udp_port,omitempty"`   // port of UDP knocks, 0 to derive it from the master key
+	DNSDomain string `toml:"dns_domain,omitempty"` // domain DNS knocks are sent under
+
+	// ServerKeys are the server's public keys by epoch, as printed by
+	// 'knockd server-key'. They take precedence over server_key.
+	ServerKeys []serverKeyConfig `toml:"server_keys,omitempty"`
+}
+
+// serverKeyConfig is a server public key and the epoch it is used in.
+type serverKeyConfig struct {
+	Key       string    `toml:"key"`                  // base64 X25519 or hybrid public key
+	NotBefore time.Time `toml:"not_before,omitempty"` // start of the epoch
+	NotAfter  time.Time `toml:"not_after,omitempty"`  // end of the epoch, when knockd erases the key
+}
+
+// currentServerKey returns the server key of the epoch at now, the one
+// that started last among the keys whose epoch includes now.
+func currentServerKey(keys []serverKeyConfig, now time.Time) (string, error) {
+	var current *serverKeyConfig
+	for i, k := range keys {
+		if (k.NotBefore.IsZero() || !now.Before(k.NotBefore)) && (k.NotAfter.IsZero() || now.Before(k.NotAfter)) &&
+			(current == nil || !k.NotBefore.Before(current.NotBefore)) {
+			current = &keys[i]
+		}
+	}
+	if current == nil {
+		return "", fmt.Errorf("no server key in kk.toml is valid now; add the key of the current epoch from 'knockd server-key'")
+	}
+	return current.Key, nil
+}
+
+// enrolled reports whether the config holds a per-agent or signing key.
+func (c *clientConfig) enrolled() bool {
+	return c.AgentKey != "" || c.SignKey != "" || c.AgentKeyName != "" || c.SignKeyName != ""
+}
+
+// clearEnrollment forgets the per-agent or signing key before a new one is
+// enrolled.
+func (c *clientConfig) clearEnrollment() {
+	c.AgentKey, c.SignKey = "", ""
+	c.AgentKeyName, c.SignKeyName = "", ""
+}
+
+// clientConfigPath returns the path of kk.toml. KK_CONFIG overrides the
+// default location in the user configuration directory. Under sudo, which
+// raw SYN knocks need, that is the directory of the invoking user rather
+// than root's, so both share one agent ID and enrollment.
+func clientConfigPath() (string, error) {
+	if path := os.Getenv("KK_CONFIG"); path != "" {
+		return path, nil
+	}
+	if u := sudoUser(); u != nil {
+		dir := filepath.Join(u.HomeDir, ".config")
+		if runtime.GOOS == "darwin" {
+			dir = filepath.Join(u.HomeDir, "Library", "Application Support")
+		}
+		return filepath.Join(dir, "knockknock", "kk.toml"), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "knockknock", "kk.toml"), nil
+}
+
+// loadClientConfig reads kk.toml. A missing file yields an empty config.
+func loadClientConfig() (*clientConfig, error) {
+	path, err := clientConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg clientConfig
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := toml.Decode(string(data), &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// save writes the config to kk.toml, readable only by the current user.
+func (c *clientConfig) save() (string, error) {
+	path, err := clientConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return path, writeTOML(path, c)
+}
+
+// sudoUser returns the user who ran kk through sudo, or nil if kk was not
+// run by root through sudo.
+func sudoUser() *user.User {
+	name := os.Getenv("SUDO_USER")
+	if os.Geteuid() != 0 || name == "" {
+		return nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil || u.Uid == "0" {
+		return nil
+	}
+	return u
+}
+
+// mkdirConfig creates dir and its missing parents. Under sudo they are
+// handed to the invoking user, whose configuration directory they are in.
+func mkdirConfig(dir string) error {
+	u := sudoUser()
+	var created []string
+	for d := dir; u != nil && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		created = append(created, d)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, d := range created {
+		if err := chownSudoUser(d, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chownSudoUser gives path to u, the user who ran kk through sudo, so that
+// files kk writes as root stay usable without sudo. u may be nil.
+func chownSudoUser(path string, u *user.User) error {
+	if u == nil {
+		return nil
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// writeTOML encodes v to path, readable only by the user. It writes a
+// temporary file next to path and renames it over path, so that a crash or
+// a full disk never leaves path truncated.
+func writeTOML(path string, v any) error {
+	if err := mkdirConfig(filepath.Dir(path)); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly after the rename
+	if err := chownSudoUser(f.Name(), sudoUser()); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := toml.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSudoConfig(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Setenv("SUDO_USER", "nobody")
+
+	// The invoking user's config, not root's
+	t.Setenv("KK_CONFIG", "")
+	path, err := clientConfigPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(u.HomeDir, ".config", "knockknock", "kk.toml"); path != want {
+		t.Errorf("clientConfigPath = %s, want %s", path, want)
+	}
+
+	// Files and directories written as root belong to the invoking user
+	dir := t.TempDir()
+	t.Setenv("KK_CONFIG", filepath.Join(dir, "knockknock", "kk.toml"))
+	if _, err := (&clientConfig{AgentID: "1"}).save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nextCounter(1); err != nil {
+		t.Fatal(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	for _, name := range []string{"knockknock", "knockknock/kk.toml", "knockknock/counters.toml", "knockknock/counters.toml.lock"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner := int(fi.Sys().(*syscall.Stat_t).Uid); owner != uid {
+			t.Errorf("%s is owned by %d, want %d", name, owner, uid)
+		}
+	}
+}
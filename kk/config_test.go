@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestWriteTOML(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "knockknock", "kk.toml")
+	for _, id := range []string{"1", "2"} {
+		if err := writeTOML(path, &clientConfig{AgentID: id}); err != nil {
+			t.Fatal(err)
+		}
+		var cfg clientConfig
+		if _, err := toml.DecodeFile(path, &cfg); err != nil || cfg.AgentID != id {
+			t.Errorf("read back %+v, %v, want agent ID %s", cfg, err, id)
+		}
+	}
+
+	// The temporary file is renamed over path, not left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the config directory, want 1", len(entries))
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+func TestCurrentServerKey(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	keys := []serverKeyConfig{
+		{Key: "october", NotBefore: day(1), NotAfter: day(31)},
+		{Key: "next", NotBefore: day(31), NotAfter: day(31).AddDate(0, 1, 0)},
+		{Key: "overlap", NotBefore: day(20), NotAfter: day(31)},
+	}
+	tests := []struct {
+		now  time.Time
+		want string
+	}{
+		{day(10), "october"},
+		{day(25), "overlap"}, // the newest epoch wins
+		{day(31), "next"},
+	}
+	for _, tt := range tests {
+		got, err := currentServerKey(keys, tt.now)
+		if err != nil || got != tt.want {
+			t.Errorf("currentServerKey at %s = %q, %v, want %q", tt.now, got, err, tt.want)
+		}
+	}
+	for _, now := range []time.Time{day(1).Add(-time.Second), day(31).AddDate(0, 1, 0)} {
+		if got, err := currentServerKey(keys, now); err == nil {
+			t.Errorf("currentServerKey at %s = %q, want an error outside every epoch", now, got)
+		}
+	}
+}
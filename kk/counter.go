@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// counterState holds the last knock counter of each agent. It lives in
+// counters.toml next to kk.toml.
+type counterState struct {
+	Counters map[string]uint64 `toml:"counters"` // keyed by decimal agent ID
+}
+
+// counterPath returns the path of counters.toml.
+func counterPath() (string, error) {
+	path, err := clientConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "counters.toml"), nil
+}
+
+// nextCounter returns the next knock counter of agentID and persists it
+// before the knock is sent. The counter never falls behind the current Unix
+// time in milliseconds, so a lost state file does not lock the agent out.
+func nextCounter(agentID uint64) (uint64, error) {
+	path, err := counterPath()
+	if err != nil {
+		return 0, err
+	}
+
+	// Serialise concurrent knocks on the lock file: counters.toml itself is
+	// replaced on every write, so a lock on it would not be seen by the next
+	// process.
+	if err := mkdirConfig(filepath.Dir(path)); err != nil {
+		return 0, err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := chownSudoUser(lock.Name(), sudoUser()); err != nil {
+		return 0, err
+	}
+	if err := lockFile(lock); err != nil {
+		return 0, err
+	}
+
+	state := counterState{Counters: make(map[string]uint64)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	if _, err := toml.Decode(string(data), &state); err != nil {
+		return 0, err
+	}
+
+	id := strconv.FormatUint(agentID, 10)
+	counter := max(state.Counters[id]+1, uint64(time.Now().UnixMilli()))
+	state.Counters[id] = counter
+
+	return counter, writeTOML(path, state)
+}
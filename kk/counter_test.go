@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestNextCounterConcurrent(t *testing.T) {
+	t.Setenv("KK_CONFIG", filepath.Join(t.TempDir(), "kk.toml"))
+
+	const knocks = 100
+	counters := make(chan uint64, knocks)
+	var wg sync.WaitGroup
+	for range knocks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counter, err := nextCounter(42)
+			if err != nil {
+				t.Error(err)
+			}
+			counters <- counter
+		}()
+	}
+	wg.Wait()
+	close(counters)
+
+	// Every knock got its own counter, and the last one was persisted
+	seen := make(map[uint64]bool)
+	var last uint64
+	for counter := range counters {
+		if seen[counter] {
+			t.Errorf("counter %d handed out twice", counter)
+		}
+		seen[counter] = true
+		last = max(last, counter)
+	}
+	next, err := nextCounter(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= last {
+		t.Errorf("next counter = %d, want more than %d", next, last)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"knockknock/spa"
+)
+
+// transportDNS sends the knock as a query for a name under the server's
+// domain, for networks that only pass DNS to a resolver.
+const transportDNS = "dns"
+
+// dnsTimeout bounds the lookup. knockd never answers, so the resolver
+// fails or times out once the query has been passed on.
+const dnsTimeout = 3 * time.Second
+
+// sendDNS encodes the knock into a query name under domain and looks it up
+// through resolver ("host:port"), or the system resolver if it is empty.
+func sendDNS(resolver, domain string, spaPacket []byte) error {
+	if domain == "" {
+		return fmt.Errorf("no DNS domain (use -domain or set dns_domain in kk.toml)")
+	}
+	name, err := spa.EncodeDNS(spaPacket, domain)
+	if err != nil {
+		return err
+	}
+
+	r := net.DefaultResolver
+	if resolver != "" {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	// The lookup is expected to fail; all that matters is that the query
+	// reaches a resolver.
+	r.LookupTXT(ctx, name)
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+
+	"knockknock/spa"
+)
+
+// credentials are the keys and identity kk send knocks with.
+type credentials struct {
+	keys    spa.Keys
+	agentID uint64
+	mode    byte
+}
+
+type enrollOptions struct {
+	masterKey    string // base64 master key to derive the agent key from
+	keyFile      string // file holding the base64 master key
+	agentKey     string // base64 per-agent key from knockd agent-key
+	agentKeyFile string // file holding the base64 per-agent key
+	agentID      string // agent ID, "" for the ID from kk init
+	keyID        uint   // key ring ID of the key, 0 for none
+	keyName      string // keystore name to store the key under
+}
+
+// enrollCmd derives or accepts this device's per-agent key and stores it in
+// kk.toml, or in the keystore under keyName. Only the derived key is
+// written, never the master key.
+func enrollCmd(opts enrollOptions) {
+	var agentID uint64
+	var err error
+	if opts.agentID != "" {
+		agentID, err = strconv.ParseUint(opts.agentID, 0, 64)
+	} else {
+		agentID, err = getAgentID()
+	}
+	if err != nil {
+		fmt.Println("Invalid agent ID:", err)
+		os.Exit(1)
+	}
+
+	key, err := enrollKey(opts, agentID)
+	if err != nil {
+		fmt.Println("Error reading key:", err)
+		os.Exit(1)
+	}
+	keyName := opts.keyName
+
+	cfg, err := loadClientConfig()
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	cfg.AgentID = strconv.FormatUint(agentID, 10)
+	cfg.clearEnrollment()
+	if keyName != "" {
+		if err := storeEnrolledKey(keyName, key); err != nil {
+			fmt.Println("Error storing key:", err)
+			os.Exit(1)
+		}
+		cfg.AgentKeyName = keyName
+	} else {
+		cfg.AgentKey = base64.StdEncoding.EncodeToString(key)
+	}
+	cfg.KeyID = uint32(opts.keyID)
+	path, err := cfg.save()
+	if err != nil {
+		fmt.Println("Error saving config:", err)
+		os.Exit(1)
+	}
+
+	if keyName != "" {
+		fmt.Printf("Enrolled agent %d, key %q stored in the keystore\n", agentID, keyName)
+	} else {
+		fmt.Printf("Enrolled agent %d, key stored in %s\n", agentID, path)
+	}
+}
+
+// enrollKey returns the agent key to enroll, from the first source that is
+// set: the agent key in -agent-key or -agent-key-file, or one derived from
+// the master key in -k, -key-file or KK_KEY. Without any, it prompts for the
+// agent key when -id is given, as printed by knockd agent-key, and for the
+// master key otherwise.
+func enrollKey(opts enrollOptions, agentID uint64) ([]byte, error) {
+	var key []byte
+	var err error
+	switch {
+	case opts.agentKey != "":
+		key, err = decodeKey(opts.agentKey)
+	case opts.agentKeyFile != "":
+		key, err = readKeyFile(opts.agentKeyFile)
+	case opts.masterKey == "" && opts.keyFile == "" && os.Getenv("KK_KEY") == "" && opts.agentID != "":
+		var encoded []byte
+		if encoded, err = readPassphrase("Agent key (base64): ", false); err == nil {
+			key, err = decodeKey(string(encoded))
+		}
+	default:
+		var master []byte
+		if master, err = masterKey(opts.masterKey, sendOptions{keyFile: opts.keyFile}); err == nil && master == nil {
+			var encoded []byte
+			if encoded, err = readPassphrase("Master key (base64): ", false); err == nil {
+				master, err = decodeKey(string(encoded))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return spa.DeriveAgentKey(master, agentID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != spa.KeySize {
+		return nil, fmt.Errorf("invalid agent key size: %d bytes, want %d", len(key), spa.KeySize)
+	}
+	return key, nil
+}
+
+// enrollSigningCmd generates an Ed25519 keypair for signed knocks, stores
+// the private key in kk.toml or in the keystore under keyName, and prints
+// the line to add to the server's authorized keys file.
+func enrollSigningCmd(name, keyName string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Println("Error generating key:", err)
+		os.Exit(1)
+	}
+	cfg, err := loadClientConfig()
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	if name == "" {
+		name = cfg.AgentName
+	}
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			name = "kk"
+		}
+	}
+	cfg.AgentID = strconv.FormatUint(spa.KeyID(pub), 10)
+	cfg.clearEnrollment()
+	if keyName != "" {
+		if err := storeEnrolledKey(keyName, priv.Seed()); err != nil {
+			fmt.Println("Error storing key:", err)
+			os.Exit(1)
+		}
+		cfg.SignKeyName = keyName
+	} else {
+		cfg.SignKey = base64.StdEncoding.EncodeToString(priv.Seed())
+	}
+	cfg.KeyID = 0
+	path, err := cfg.save()
+	if err != nil {
+		fmt.Println("Error saving config:", err)
+		os.Exit(1)
+	}
+
+	if keyName != "" {
+		fmt.Printf("Signing key %q stored in the keystore\n", keyName)
+	} else {
+		fmt.Printf("Signing key stored in %s\n", path)
+	}
+	fmt.Println("Add the following line to the server's authorized keys file:")
+	fmt.Printf("ed25519 %s %s\n", base64.StdEncoding.EncodeToString(pub), name)
+}
+
+// loadCredentials returns the shared master key credentials if masterKey is
+// set, and the enrolled per-agent credentials from kk.toml otherwise.
+func loadCredentials(masterKey []byte) (*credentials, error) {
+	if masterKey != nil {
+		keys, err := spa.DeriveKeys(masterKey)
+		if err != nil {
+			return nil, err
+		}
+		agentID, err := getAgentID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get agent id: %w", err)
+		}
+		return &credentials{keys: keys, agentID: agentID, mode: spa.ModeShared}, nil
+	}
+
+	cfg, err := loadClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if !cfg.enrolled() {
+		return nil, fmt.Errorf("no key given and this device is not enrolled (run kk enroll)")
+	}
+	agentID, err := strconv.ParseUint(cfg.AgentID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent_id in config: %w", err)
+	}
+
+	if cfg.SignKey != "" || cfg.SignKeyName != "" {
+		seed, err := enrolledKey(cfg.SignKey, cfg.SignKeyName)
+		if err != nil {
+			return nil, err
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid sign_key in config")
+		}
+		keys := spa.Keys{SignKey: ed25519.NewKeyFromSeed(seed)}
+		return &credentials{keys: keys, agentID: agentID, mode: spa.ModeSigned}, nil
+	}
+
+	agentKey, err := enrolledKey(cfg.AgentKey, cfg.AgentKeyName)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := spa.DeriveKeys(agentKey)
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{keys: keys, agentID: agentID, mode: spa.ModeAgent}, nil
+}
+
+// enrolledKey returns the enrolled key, from the keystore if name is set
+// and decoded from its base64 kk.toml entry otherwise.
+func enrolledKey(encoded, name string) ([]byte, error) {
+	if name == "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in config: %w", err)
+		}
+		return key, nil
+	}
+	ks, err := loadKeystore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keystore: %w", err)
+	}
+	passphrase, err := readPassphrase("Keystore passphrase: ", false)
+	if err != nil {
+		return nil, err
+	}
+	return ks.get(passphrase, name)
+}
+
+// storeEnrolledKey seals an enrolled key in the keystore under name.
+func storeEnrolledKey(name string, key []byte) error {
+	ks, err := loadKeystore()
+	if err != nil {
+		return fmt.Errorf("failed to load keystore: %w", err)
+	}
+	passphrase, err := readPassphrase("Keystore passphrase: ", len(ks.Keys) == 0)
+	if err != nil {
+		return err
+	}
+	if err := ks.add(passphrase, name, key); err != nil {
+		return err
+	}
+	return ks.save()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"knockknock/spa"
+)
+
+func TestEnrollKey(t *testing.T) {
+	master := bytes.Repeat([]byte{0x11}, spa.KeySize)
+	agent := bytes.Repeat([]byte{0x22}, spa.KeySize)
+	const agentID = 42
+	derived, err := spa.DeriveAgentKey(master, agentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	masterFile := filepath.Join(dir, "master.key")
+	agentFile := filepath.Join(dir, "agent.key")
+	if err := os.WriteFile(masterFile, []byte(base64.StdEncoding.EncodeToString(master)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(agentFile, []byte(base64.StdEncoding.EncodeToString(agent)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		opts  enrollOptions
+		kkKey string
+		want  []byte
+	}{
+		{"master key file", enrollOptions{keyFile: masterFile}, "", derived},
+		{"KK_KEY", enrollOptions{}, base64.StdEncoding.EncodeToString(master), derived},
+		{"KK_KEY with an agent ID", enrollOptions{agentID: "42"}, base64.StdEncoding.EncodeToString(master), derived},
+		{"agent key file", enrollOptions{agentID: "42", agentKeyFile: agentFile}, "", agent},
+		{"agent key file over KK_KEY", enrollOptions{agentKeyFile: agentFile}, base64.StdEncoding.EncodeToString(master), agent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("KK_KEY", tt.kkKey)
+			key, err := enrollKey(tt.opts, agentID)
+			if err != nil || !bytes.Equal(key, tt.want) {
+				t.Errorf("enrollKey = %x, %v, want %x", key, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := enrollKey(enrollOptions{agentKey: base64.StdEncoding.EncodeToString(agent[:16])}, agentID); err == nil {
+		t.Error("short agent key accepted")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	mrand "math/rand/v2"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"knockknock/spa"
+)
+
+// transportICMP sends the knock in the body of an ICMP echo request.
+const transportICMP = "icmp"
+
+// sendICMP sends the knock as a ping. It uses an unprivileged ping socket
+// where the kernel allows one (net.ipv4.ping_group_range on Linux) and falls
+// back to a raw ICMP socket otherwise. The kernel fills in the ICMPv6
+// checksum.
+func sendICMP(serverIP net.IP, spaPacket []byte) error {
+	var echo icmp.Type = ipv4.ICMPTypeEcho
+	network, rawNetwork, laddr := "udp4", "ip4:icmp", "0.0.0.0"
+	if ipFamily(serverIP) == 6 {
+		echo = ipv6.ICMPTypeEchoRequest
+		network, rawNetwork, laddr = "udp6", "ip6:ipv6-icmp", "::"
+	}
+
+	msg := icmp.Message{
+		Type: echo,
+		Body: &icmp.Echo{ID: mrand.IntN(0x10000), Seq: 1, Data: spa.EncodeUDP(spaPacket)},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: serverIP}
+	conn, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		if conn, err = icmp.ListenPacket(rawNetwork, laddr); err != nil {
+			return fmt.Errorf("failed to open ICMP socket: %w", err)
+		}
+		dst = &net.IPAddr{IP: serverIP}
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteTo(b, dst)
+	return err
+}
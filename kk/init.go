@@ -6,9 +6,25 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strconv"
+
+	"knockknock/spa"
 )
 
-func initCmd() {
+// initOptions holds the settings of kk init.
+type initOptions struct {
+	passphrase bool   // derive the key from a passphrase
+	name       string // human-readable agent name
+	legacyID   bool   // keep the MAC-derived ID of older versions
+}
+
+func initCmd(opts initOptions) {
+	initAgent(opts.name, opts.legacyID)
+	if opts.passphrase {
+		initPassphraseCmd()
+		return
+	}
+
 	key := make([]byte, 32)
 
 	if _, err := rand.Read(key); err != nil {
@@ -18,3 +34,93 @@ func initCmd() {
 
 	fmt.Println("key = \"" + base64.StdEncoding.EncodeToString(key) + "\"")
 }
+
+// initPassphraseCmd derives the master key from a passphrase and a new
+// random salt. The salt is stored in kk.toml; the key is only printed for
+// knockd.toml.
+func initPassphraseCmd() {
+	passphrase, err := readPassphrase("Passphrase: ", true)
+	if err != nil {
+		fmt.Println("Error reading passphrase:", err)
+		os.Exit(1)
+	}
+
+	salt := make([]byte, spa.SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		fmt.Println("Error generating salt:", err)
+		os.Exit(1)
+	}
+	key, err := spa.DeriveMasterKey(passphrase, salt)
+	if err != nil {
+		fmt.Println("Error deriving key:", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadClientConfig()
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	cfg.Salt = base64.StdEncoding.EncodeToString(salt)
+	if _, err := cfg.save(); err != nil {
+		fmt.Println("Error saving config:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Add the key to knockd.toml:")
+	fmt.Println("key = \"" + base64.StdEncoding.EncodeToString(key) + "\"")
+	fmt.Println("Knock from any machine with the passphrase and this salt:")
+	fmt.Println("kk send -s <server_ip> -passphrase -salt " + cfg.Salt)
+}
+
+// initAgent gives this device a persistent agent identity in kk.toml. A new
+// random ID is only generated if none is stored yet; legacy keeps the ID
+// older versions derived from the MAC address.
+func initAgent(name string, legacy bool) {
+	cfg, err := loadClientConfig()
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+
+	legacyID, legacyErr := legacyAgentID()
+	generated := false
+	switch {
+	case legacy:
+		if legacyErr != nil {
+			fmt.Println("Error deriving legacy agent ID:", legacyErr)
+			os.Exit(1)
+		}
+		id := strconv.FormatUint(legacyID, 10)
+		if cfg.AgentID != "" && cfg.AgentID != id && cfg.enrolled() {
+			fmt.Printf("This device is enrolled as agent %s; its key is bound to that ID\n", cfg.AgentID)
+			os.Exit(1)
+		}
+		cfg.AgentID = id
+	case cfg.AgentID == "":
+		agentID, err := newAgentID()
+		if err != nil {
+			fmt.Println("Error generating agent ID:", err)
+			os.Exit(1)
+		}
+		cfg.AgentID = strconv.FormatUint(agentID, 10)
+		generated = true
+	}
+	if name != "" {
+		cfg.AgentName = name
+	}
+	if _, err := cfg.save(); err != nil {
+		fmt.Println("Error saving config:", err)
+		os.Exit(1)
+	}
+
+	if cfg.AgentName != "" {
+		fmt.Printf("Agent ID: %s (%s)\n", cfg.AgentID, cfg.AgentName)
+	} else {
+		fmt.Printf("Agent ID: %s\n", cfg.AgentID)
+	}
+	if generated && legacyErr == nil {
+		fmt.Printf("Older versions of kk used agent ID %d on this device. To keep its history on the server, run:\n", legacyID)
+		fmt.Printf("  knockd migrate-agent %d %s\n", legacyID, cfg.AgentID)
+	}
+}
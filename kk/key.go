@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const keyUsage = `Usage: kk key <command>
+
+Commands:
+  add [-key-file <path>] <name>   Store a master key in the keystore; it is
+                                  prompted for unless -key-file is given
+  list                            List the stored keys
+  remove <name>                   Delete a stored key
+  export <name>                   Print a stored key`
+
+// keyCmd manages the encrypted keystore.
+func keyCmd(args []string) {
+	if err := keyCommand(args); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func keyCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", keyUsage)
+	}
+	ks, err := loadKeystore()
+	if err != nil {
+		return fmt.Errorf("failed to load keystore: %w", err)
+	}
+
+	switch args[0] {
+	case "add":
+		addFlags := flag.NewFlagSet("key add", flag.ExitOnError)
+		keyFile := addFlags.String("key-file", "", "Read the key (base64) from this file instead of prompting")
+		addFlags.Parse(args[1:])
+		if addFlags.NArg() != 1 {
+			return fmt.Errorf("usage: kk key add [-key-file <path>] <name>")
+		}
+		name := addFlags.Arg(0)
+
+		var key []byte
+		if *keyFile != "" {
+			key, err = readKeyFile(*keyFile)
+		} else {
+			var encoded []byte
+			if encoded, err = readPassphrase("Key (base64): ", false); err == nil {
+				key, err = decodeKey(string(encoded))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		passphrase, err := readPassphrase("Keystore passphrase: ", len(ks.Keys) == 0)
+		if err != nil {
+			return err
+		}
+		if err := ks.add(passphrase, name, key); err != nil {
+			return err
+		}
+		if err := ks.save(); err != nil {
+			return err
+		}
+		fmt.Printf("Key %q added\n", name)
+		return nil
+
+	case "list":
+		for _, k := range ks.Keys {
+			fmt.Println(k.Name)
+		}
+		return nil
+
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: kk key remove <name>")
+		}
+		if err := ks.remove(args[1]); err != nil {
+			return err
+		}
+		if err := ks.save(); err != nil {
+			return err
+		}
+		fmt.Printf("Key %q removed\n", args[1])
+		return nil
+
+	case "export":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: kk key export <name>")
+		}
+		passphrase, err := readPassphrase("Keystore passphrase: ", false)
+		if err != nil {
+			return err
+		}
+		key, err := ks.get(passphrase, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown key command: %s\n\n%s", args[0], keyUsage)
+	}
+}
+
+// masterKey returns the master key from the first source that is set: -k,
+// -key-file, the keystore, a passphrase, or the KK_KEY environment variable.
+// It returns nil to use the enrolled agent key.
+func masterKey(key string, opts sendOptions) ([]byte, error) {
+	switch {
+	case key != "":
+		return decodeKey(key)
+	case opts.keyFile != "":
+		return readKeyFile(opts.keyFile)
+	case opts.keyName != "":
+		ks, err := loadKeystore()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load keystore: %w", err)
+		}
+		passphrase, err := readPassphrase("Keystore passphrase: ", false)
+		if err != nil {
+			return nil, err
+		}
+		return ks.get(passphrase, opts.keyName)
+	case opts.passphrase:
+		return passphraseKey(opts.salt)
+	case os.Getenv("KK_KEY") != "":
+		return decodeKey(os.Getenv("KK_KEY"))
+	}
+	return nil, nil
+}
+
+// readKeyFile reads a base64 key from a file.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(string(data))
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 for key: %w", err)
+	}
+	return key, nil
+}
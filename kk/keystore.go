@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters of the keystore passphrase.
+const (
+	keystoreSaltSize = 16
+	keystoreTime     = 3
+	keystoreMemory   = 64 * 1024 // KiB
+	keystoreThreads  = 4
+)
+
+// errWrongPassphrase is returned when the keystore cannot be unlocked.
+var errWrongPassphrase = errors.New("wrong keystore passphrase")
+
+// keystore holds master keys and enrolled keys encrypted under a passphrase. It lives in
+// keystore.toml next to kk.toml. Key names are stored in clear so that they
+// can be listed without the passphrase.
+type keystore struct {
+	Salt string        `toml:"salt"` // base64 Argon2id salt
+	Keys []keystoreKey `toml:"keys"`
+}
+
+// keystoreKey is a named key sealed with AES-256-GCM, with the name as
+// additional data.
+type keystoreKey struct {
+	Name   string `toml:"name"`
+	Sealed string `toml:"sealed"` // base64 nonce | ciphertext
+}
+
+// keystorePath returns the path of keystore.toml.
+func keystorePath() (string, error) {
+	path, err := clientConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "keystore.toml"), nil
+}
+
+// loadKeystore reads keystore.toml. A missing file yields an empty keystore.
+func loadKeystore() (*keystore, error) {
+	path, err := keystorePath()
+	if err != nil {
+		return nil, err
+	}
+
+	var ks keystore
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := toml.Decode(string(data), &ks); err != nil {
+		return nil, err
+	}
+	return &ks, nil
+}
+
+// save writes the keystore, readable only by the current user.
+func (ks *keystore) save() error {
+	path, err := keystorePath()
+	if err != nil {
+		return err
+	}
+	return writeTOML(path, ks)
+}
+
+// aead derives the keystore cipher from passphrase, creating the salt of a
+// new keystore.
+func (ks *keystore) aead(passphrase []byte) (cipher.AEAD, error) {
+	if ks.Salt == "" {
+		salt := make([]byte, keystoreSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		ks.Salt = base64.StdEncoding.EncodeToString(salt)
+	}
+	salt, err := base64.StdEncoding.DecodeString(ks.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keystore salt: %w", err)
+	}
+
+	key := argon2.IDKey(passphrase, salt, keystoreTime, keystoreMemory, keystoreThreads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// index returns the position of the key called name, or -1.
+func (ks *keystore) index(name string) int {
+	return slices.IndexFunc(ks.Keys, func(k keystoreKey) bool { return k.Name == name })
+}
+
+// add seals key under name. The passphrase must unlock the existing keys.
+func (ks *keystore) add(passphrase []byte, name string, key []byte) error {
+	if ks.index(name) >= 0 {
+		return fmt.Errorf("key %q already exists", name)
+	}
+	aead, err := ks.aead(passphrase)
+	if err != nil {
+		return err
+	}
+	if len(ks.Keys) > 0 {
+		if _, err := ks.open(aead, ks.Keys[0]); err != nil {
+			return err
+		}
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, key, []byte(name))
+	ks.Keys = append(ks.Keys, keystoreKey{Name: name, Sealed: base64.StdEncoding.EncodeToString(sealed)})
+	return nil
+}
+
+// get returns the key called name.
+func (ks *keystore) get(passphrase []byte, name string) ([]byte, error) {
+	i := ks.index(name)
+	if i < 0 {
+		return nil, fmt.Errorf("no key %q in keystore", name)
+	}
+	aead, err := ks.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ks.open(aead, ks.Keys[i])
+}
+
+// remove deletes the key called name.
+func (ks *keystore) remove(name string) error {
+	i := ks.index(name)
+	if i < 0 {
+		return fmt.Errorf("no key %q in keystore", name)
+	}
+	ks.Keys = slices.Delete(ks.Keys, i, i+1)
+	return nil
+}
+
+func (ks *keystore) open(aead cipher.AEAD, k keystoreKey) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(k.Sealed)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("corrupt keystore entry %q", k.Name)
+	}
+	key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(k.Name))
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return key, nil
+}
@@ -9,24 +9,88 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: kk <init|send>")
+		fmt.Println("Usage: kk <init|enroll|key|send|close>")
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "init":
-		initCmd()
-	case "send":
-		sendFlags := flag.NewFlagSet("send", flag.ExitOnError)
-		serverIP := sendFlags.String("s", "", "Server IP address")
-		key := sendFlags.String("k", "", "Master key (base64)")
+		initFlags := flag.NewFlagSet("init", flag.ExitOnError)
+		var opts initOptions
+		initFlags.BoolVar(&opts.passphrase, "passphrase", false, "Derive the key from a passphrase and a new random salt")
+		initFlags.StringVar(&opts.name, "name", "", "Human-readable name of this agent")
+		initFlags.BoolVar(&opts.legacyID, "legacy-id", false, "Keep the MAC-derived agent ID of older kk versions")
+		initFlags.Parse(os.Args[2:])
+		initCmd(opts)
+	case "enroll":
+		enrollFlags := flag.NewFlagSet("enroll", flag.ExitOnError)
+		var opts enrollOptions
+		enrollFlags.StringVar(&opts.masterKey, "k", "", "Master key (base64) to derive this device's key from; it is not stored. Visible in ps and shell history, prefer -key-file, KK_KEY or the prompt")
+		enrollFlags.StringVar(&opts.keyFile, "key-file", "", "File holding the master key (base64)")
+		enrollFlags.StringVar(&opts.agentKey, "agent-key", "", "Per-agent key (base64) from 'knockd agent-key'; visible in ps and shell history, prefer -agent-key-file or the prompt")
+		enrollFlags.StringVar(&opts.agentKeyFile, "agent-key-file", "", "File holding the per-agent key (base64)")
+		enrollFlags.StringVar(&opts.agentID, "id", "", "Agent ID (default: the ID from kk init); without a key, prompt for the agent key")
+		enrollFlags.UintVar(&opts.keyID, "key-id", 0, "Server key ring ID of the key, as printed by 'knockd agent-key'")
+		signing := enrollFlags.Bool("ed25519", false, "Generate an Ed25519 keypair for signed knocks instead")
+		name := enrollFlags.String("name", "", "Agent name for the authorized keys line (default: agent_name from kk.toml, or hostname)")
+		enrollFlags.StringVar(&opts.keyName, "key-name", "", "Store the key in the keystore under this name instead of in kk.toml")
+		enrollFlags.Parse(os.Args[2:])
+
+		if *signing {
+			enrollSigningCmd(*name, opts.keyName)
+		} else {
+			enrollCmd(opts)
+		}
+	case "key":
+		keyCmd(os.Args[2:])
+	case "send", "close":
+		cmd := os.Args[1]
+		sendFlags := flag.NewFlagSet(cmd, flag.ExitOnError)
+		server := sendFlags.String("s", "", "Server host name or IP address")
+		key := sendFlags.String("k", "", "Master key (base64); visible in ps and shell history, prefer -key-file, -key-name or KK_KEY")
+		opts := sendOptions{close: cmd == "close"}
+		sendFlags.StringVar(&opts.keyFile, "key-file", "", "File holding the master key (base64)")
+		sendFlags.StringVar(&opts.keyName, "key-name", "", "Name of the master key in the keystore (see kk key)")
+		sendFlags.BoolVar(&opts.passphrase, "passphrase", false, "Prompt for the passphrase to derive the master key from")
+		sendFlags.StringVar(&opts.salt, "salt", "", "Salt (base64) for -passphrase (default: salt from kk.toml)")
+		sendFlags.UintVar(&opts.keyID, "key-id", 0, "Server key ring ID of the key (default: key_id from kk.toml)")
+		sendFlags.IntVar(&opts.proto, "proto", 3, "Protocol version (3, or 2 for legacy servers)")
+		sendFlags.StringVar(&opts.cipher, "cipher", "aes-gcm", "v3 cipher suite (aes-gcm or chacha20-poly1305)")
+		sendFlags.StringVar(&opts.serverKey, "server-key", "", "Server X25519 or hybrid public key (base64) to seal the knock to (default: the key of the current epoch in kk.toml)")
+		sendFlags.StringVar(&opts.serverID, "server-id", "", "Server ID to bind the knock to (default: server_id from kk.toml)")
+		if !opts.close {
+			sendFlags.StringVar(&opts.services, "service", "", "Services to open, comma-separated (default: the server's allow_ports)")
+			sendFlags.DurationVar(&opts.ttl, "ttl", 0, "Requested access duration, e.g. 5m; the server may grant less (default: server decides)")
+			sendFlags.BoolVar(&opts.otp, "otp", false, "Prompt for a TOTP code to include as a second factor")
+			sendFlags.StringVar(&opts.otpCmd, "otp-cmd", "", "Command that prints the TOTP code, instead of prompting")
+		}
+		sendFlags.StringVar(&opts.transport, "transport", transportTCP, "How to send the knock: tcp (raw SYN, needs root), udp, icmp (echo request) or dns (query via a resolver)")
+		sendFlags.IntVar(&opts.port, "port", 0, "UDP port for -transport udp (default: udp_port from kk.toml, or derived from the master key)")
+		sendFlags.StringVar(&opts.domain, "domain", "", "Server domain for -transport dns (default: dns_domain from kk.toml)")
+		sendFlags.StringVar(&opts.resolver, "resolver", "", "Resolver address for -transport dns (default: the system resolver)")
+		sendFlags.StringVar(&opts.source, "source", "", "Address to be granted, or 'packet' to use the packet source behind NAT (default: local address, or source from kk.toml)")
+		only4 := sendFlags.Bool("4", false, "Knock over IPv4 only")
+		only6 := sendFlags.Bool("6", false, "Knock over IPv6 only (default: both, IPv6 first)")
 		sendFlags.Parse(os.Args[2:])
 
-		if *serverIP == "" || *key == "" {
-			fmt.Println("Usage: kk send -s <server_ip> -k <key>")
+		switch {
+		case *only4 && *only6:
+			fmt.Println("-4 and -6 are mutually exclusive")
+			os.Exit(1)
+		case *only4:
+			opts.family = 4
+		case *only6:
+			opts.family = 6
+		}
+		if *server == "" {
+			if opts.close {
+				fmt.Println("Usage: kk close -s <server> [-4|-6] [-k <key>]")
+			} else {
+				fmt.Println("Usage: kk send -s <server> [-4|-6] [-k <key>] [-transport udp|icmp|dns] [-service <name>] [-ttl <duration>] [-otp] [-proto 3] [-cipher aes-gcm]")
+			}
 			os.Exit(1)
 		}
-		sendCmd(*serverIP, *key)
+		sendCmd(*server, *key, opts)
 	default:
 		fmt.Println("Unknown command:", os.Args[1])
 		os.Exit(1)
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// readOTP returns the one-time code for a knock. It runs otpCmd if set and
+// uses the first line of its output, otherwise it prompts on the terminal.
+func readOTP(otpCmd string) (string, error) {
+	var line string
+	if otpCmd != "" {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", otpCmd)
+		} else {
+			cmd = exec.Command("sh", "-c", otpCmd)
+		}
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("OTP command failed: %w", err)
+		}
+		line, _, _ = strings.Cut(string(output), "\n")
+	} else {
+		fmt.Print("OTP code: ")
+		var err error
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read OTP code: %w", err)
+		}
+	}
+
+	code := strings.TrimSpace(line)
+	if code == "" {
+		return "", fmt.Errorf("empty OTP code")
+	}
+	return code, nil
+}
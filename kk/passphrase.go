@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+
+	"knockknock/spa"
+)
+
+// readPassphrase prompts for a passphrase or other secret without echoing
+// it. With confirm it is asked for twice.
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("a terminal is required to read secrets")
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty input")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, fmt.Errorf("inputs do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// passphraseKey prompts for the passphrase and derives the master key from
+// it and the base64 salt.
+func passphraseKey(salt string) ([]byte, error) {
+	if salt == "" {
+		return nil, fmt.Errorf("no salt given (use -salt or set salt in kk.toml)")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 for salt: %w", err)
+	}
+	passphrase, err := readPassphrase("Passphrase: ", false)
+	if err != nil {
+		return nil, err
+	}
+	return spa.DeriveMasterKey(passphrase, saltBytes)
+}
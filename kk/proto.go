@@ -1,59 +1,110 @@
-
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
+	"crypto/ecdh"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/binary"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"time"
-)
+	"math"
+	"net"
+	"strings"
 
-const (
-	protocolVersion = 0x02
+	"knockknock/spa"
 )
 
-func createPacket(keyE, keyH []byte, serverIP string) ([]byte, error) {
-	// 1. Plaintext - enhanced with 16-byte nonce
-	plainText := make([]byte, 29) // Increased from 21 to 29 bytes
-	plainText[0] = protocolVersion
-	binary.BigEndian.PutUint32(plainText[1:5], uint32(time.Now().Unix()))
-	
-	agentID, err := getAgentID()
+var cipherSuites = map[string]byte{
+	"aes-gcm":           spa.SuiteAES256GCM,
+	"chacha20-poly1305": spa.SuiteChaCha20Poly1305,
+}
+
+// errClearOTP is returned for OTP codes in signed knocks that are not
+// sealed, which would carry the code in clear.
+var errClearOTP = errors.New("OTP codes in signed knocks require a server key to seal the knock to")
+
+// createPacket builds the knock for serverIP. clientIP is the address to be
+// granted; nil leaves it to the packet source.
+func createPacket(creds *credentials, serverIP, clientIP net.IP, opts sendOptions) ([]byte, error) {
+	knock, err := spa.NewKnock(creds.agentID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get agent id: %w", err)
+		return nil, err
+	}
+	knock.Mode = creds.mode
+
+	switch opts.proto {
+	case spa.Version3:
+		suite, ok := cipherSuites[opts.cipher]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", opts.cipher)
+		}
+		knock.Suite = suite
+		if creds.mode == spa.ModeSigned {
+			knock.Suite = spa.SuiteNone
+		} else {
+			// Name the key ring entry so the server need not try every key
+			if opts.keyID > math.MaxUint32 {
+				return nil, fmt.Errorf("invalid key ID: %d", opts.keyID)
+			}
+			knock.KeyID = uint32(opts.keyID)
+		}
+		// Bind the knock to the server so it cannot be replayed to another one
+		if opts.serverID != "" {
+			knock.ServerID = opts.serverID
+		} else {
+			knock.ServerAddr = serverIP
+		}
+		// Bind the grant to our address so a captured knock cannot be
+		// re-sent from another one
+		knock.ClientAddr = clientIP
+		knock.AnySource = clientIP == nil
+		if opts.services != "" {
+			knock.Services = strings.Split(opts.services, ",")
+		}
+		if opts.ttl < 0 {
+			return nil, fmt.Errorf("invalid TTL: %s", opts.ttl)
+		}
+		knock.TTL = opts.ttl
+		knock.Close = opts.close
+		knock.Counter = opts.counter
+		if opts.otpCode != "" && creds.mode == spa.ModeSigned && opts.serverKey == "" {
+			return nil, errClearOTP
+		}
+		knock.OTP = opts.otpCode
+	case spa.Version2:
+		if creds.mode != spa.ModeShared {
+			return nil, fmt.Errorf("protocol v2 requires the shared master key")
+		}
+		if opts.services != "" || opts.ttl != 0 || opts.close || opts.otpCode != "" {
+			return nil, fmt.Errorf("services, TTL hints, OTP codes and close knocks require protocol v3")
+		}
+		knock.Version = spa.Version2
+	default:
+		return nil, fmt.Errorf("unsupported protocol version: %d", opts.proto)
 	}
-	binary.BigEndian.PutUint64(plainText[5:13], agentID)
 
-	// Enhanced 16-byte nonce for better security
-	if _, err := rand.Read(plainText[13:29]); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	packet, err := spa.Encode(creds.keys, knock, rand.Reader)
+	if err != nil || opts.serverKey == "" {
+		return packet, err
 	}
 
-	// 2. Encrypt
-	iv := make([]byte, 16)
-	if _, err := rand.Read(iv); err != nil {
-		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	if knock.Version != spa.Version3 {
+		return nil, fmt.Errorf("sealed knocks require protocol v3")
 	}
-	block, err := aes.NewCipher(keyE)
+	raw, err := base64.StdEncoding.DecodeString(opts.serverKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, fmt.Errorf("invalid base64 for server key: %w", err)
 	}
-	stream := cipher.NewCTR(block, iv)
-	cipherText := make([]byte, len(plainText))
-	stream.XORKeyStream(cipherText, plainText)
-
-	// 3. MAC
-	mac := hmac.New(sha256.New, keyH)
-	mac.Write(cipherText)
-	hmacResult := mac.Sum(nil)[:16]
-
-	// 4. Assemble packet
-	packet := append(cipherText, hmacResult...)
-	packet = append(packet, iv...)
-
-	return packet, nil
+	suite := cipherSuites[opts.cipher]
+	if len(raw) == spa.HybridPublicKeySize {
+		serverKey, err := spa.ParseHybridPublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server key: %w", err)
+		}
+		return spa.SealHybrid(serverKey, suite, packet, rand.Reader)
+	}
+	serverKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server key: %w", err)
+	}
+	return spa.Seal(serverKey, suite, packet, rand.Reader)
 }
@@ -1,58 +1,242 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
+	mrand "math/rand/v2"
 	"net"
 	"os"
+	"slices"
 	"syscall"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-)
 
-func deriveKeys(masterKey []byte) ([]byte, []byte) {
-	hmacE := hmac.New(sha256.New, masterKey)
-	hmacE.Write([]byte("knockknock-encrypt"))
-	keyE := hmacE.Sum(nil)
+	"knockknock/spa"
+)
 
-	hmacH := hmac.New(sha256.New, masterKey)
-	hmacH.Write([]byte("knockknock-hmac"))
-	keyH := hmacH.Sum(nil)
+// sourcePacket is the source setting for clients behind NAT.
+const sourcePacket = "packet"
 
-	return keyE, keyH
+// sendOptions holds the optional settings of kk send.
+type sendOptions struct {
+	proto      int
+	cipher     string
+	serverKey  string        // base64 X25519 public key to seal the knock to
+	serverID   string        // server identity to bind the knock to
+	source     string        // address to be granted, or "packet" behind NAT
+	services   string        // comma-separated services to open
+	ttl        time.Duration // requested grant duration, 0 for the server default
+	close      bool          // revoke the open grants instead of knocking
+	counter    uint64        // per-agent knock counter, 0 for none
+	otp        bool          // prompt for a one-time code
+	otpCmd     string        // command printing the one-time code
+	otpCode    string        // one-time code to include
+	passphrase bool          // derive the master key from a passphrase
+	salt       string        // base64 salt for the passphrase
+	keyFile    string        // file holding the base64 master key
+	keyName    string        // name of the master key in the keystore
+	keyID      uint          // key ring ID of the master key, 0 for none
+	transport  string        // how the knock is sent: "tcp", "udp", "icmp" or "dns"
+	port       int           // UDP port, 0 for the port derived from the key
+	domain     string        // DNS domain of the server for DNS knocks
+	resolver   string        // resolver for DNS knocks, "" for the system one
+	family     int           // 4 or 6 to knock over one address family only
 }
 
-func sendCmd(serverIPStr, key string) {
-	keyBytes, err := base64.StdEncoding.DecodeString(key)
+func sendCmd(server, key string, opts sendOptions) {
+	if opts.serverKey == "" || opts.serverID == "" || opts.source == "" || opts.salt == "" || opts.keyID == 0 || opts.port == 0 || opts.domain == "" {
+		cfg, err := loadClientConfig()
+		if err != nil {
+			fmt.Println("Error loading config:", err)
+			os.Exit(1)
+		}
+		if opts.salt == "" {
+			opts.salt = cfg.Salt
+		}
+		if opts.serverKey == "" && len(cfg.ServerKeys) > 0 {
+			if opts.serverKey, err = currentServerKey(cfg.ServerKeys, time.Now()); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+		} else if opts.serverKey == "" {
+			opts.serverKey = cfg.ServerKey
+		}
+		if opts.serverID == "" {
+			opts.serverID = cfg.ServerID
+		}
+		if opts.source == "" {
+			opts.source = cfg.Source
+		}
+		if opts.keyID == 0 {
+			opts.keyID = uint(cfg.KeyID)
+		}
+		if opts.port == 0 {
+			opts.port = cfg.UDPPort
+		}
+		if opts.domain == "" {
+			opts.domain = cfg.DNSDomain
+		}
+	}
+
+	master, err := masterKey(key, opts)
 	if err != nil {
-		fmt.Println("Invalid base64 for key:", err)
+		fmt.Println("Error reading key:", err)
+		os.Exit(1)
+	}
+	creds, err := loadCredentials(master)
+	if err != nil {
+		fmt.Println("Error loading credentials:", err)
 		os.Exit(1)
 	}
 
-	keyE, keyH := deriveKeys(keyBytes)
-
-	spaPacket, err := createPacket(keyE, keyH, serverIPStr)
+	// An explicit client address only fits knocks over its own family
+	family := opts.family
+	if ip := net.ParseIP(opts.source); ip != nil && family == 0 && opts.transport != transportDNS {
+		family = ipFamily(ip)
+	}
+	targets, err := knockTargets(server, family)
 	if err != nil {
-		fmt.Println("Error creating SPA packet:", err)
+		fmt.Println("Error:", err)
 		os.Exit(1)
 	}
+	if ip := net.ParseIP(opts.source); ip != nil && opts.transport == transportDNS && ipFamily(targets[0]) != ipFamily(ip) {
+		// Knock the server address of the client's family first; targets
+		// holds at most one address per family.
+		slices.Reverse(targets)
+	}
 
-	// --- Raw Packet Sending Logic ---
+	if opts.otp || opts.otpCmd != "" {
+		if creds.mode == spa.ModeSigned && opts.serverKey == "" {
+			fmt.Println("Error:", errClearOTP)
+			os.Exit(1)
+		}
+		opts.otpCode, err = readOTP(opts.otpCmd)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
 
-	serverIP := net.ParseIP(serverIPStr)
-	if serverIP == nil {
-		fmt.Println("Invalid server IP address")
+	sent := 0
+	for _, serverIP := range targets {
+		if err := knock(creds, master, serverIP, opts); err != nil {
+			fmt.Printf("Error knocking %s: %v\n", serverIP, err)
+			continue
+		}
+		sent++
+		if opts.close {
+			fmt.Println("Close knock sent successfully to", serverIP)
+		} else {
+			fmt.Println("Knock sent successfully to", serverIP)
+		}
+		if opts.transport == transportDNS {
+			break // the resolver carries the knock, so one is enough
+		}
+	}
+	if sent == 0 {
 		os.Exit(1)
 	}
+}
+
+// knock builds a knock for serverIP and sends it over the chosen transport.
+func knock(creds *credentials, master []byte, serverIP net.IP, opts sendOptions) error {
+	// SYNs and knocks naming the local address need a source IP. We can
+	// get it by pretending to dial the server.
+	var srcIP net.IP
+	if opts.transport == transportTCP || opts.source == "" {
+		var err error
+		if srcIP, err = findSourceAddress(serverIP); err != nil {
+			return fmt.Errorf("could not find source IP: %w", err)
+		}
+	}
 
-	// We need a source IP. We can get it by pretending to dial the server.
-	srcIP, err := findSourceAddress(serverIPStr)
+	clientIP, err := grantAddress(opts.source, srcIP, serverIP)
 	if err != nil {
-		fmt.Printf("Could not find source IP: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	// DNS knocks reach the server from the resolver, so the knock itself
+	// must name the address to grant.
+	if opts.transport == transportDNS && (clientIP == nil || opts.proto != spa.Version3) {
+		return fmt.Errorf("DNS knocks need protocol v3 and a client address (-source <public address> behind NAT)")
+	}
+
+	if opts.proto == spa.Version3 {
+		if opts.counter, err = nextCounter(creds.agentID); err != nil {
+			return fmt.Errorf("failed to update knock counter: %w", err)
+		}
+	}
+
+	spaPacket, err := createPacket(creds, serverIP, clientIP, opts)
+	if err != nil {
+		return fmt.Errorf("failed to create SPA packet: %w", err)
+	}
+
+	switch opts.transport {
+	case transportTCP:
+		return sendSYN(srcIP, serverIP, spaPacket)
+	case transportUDP:
+		port, err := knockPort(opts.port, master)
+		if err != nil {
+			return err
+		}
+		return sendUDP(serverIP, port, spaPacket)
+	case transportICMP:
+		return sendICMP(serverIP, spaPacket)
+	case transportDNS:
+		return sendDNS(opts.resolver, opts.domain, spaPacket)
+	default:
+		return fmt.Errorf("unknown transport: %s", opts.transport)
+	}
+}
+
+// knockTargets resolves server to the addresses to knock: one per address
+// family, IPv6 first, in the spirit of Happy Eyeballs (RFC 8305). family 4
+// or 6 restricts the targets to that family.
+func knockTargets(server string, family int) ([]net.IP, error) {
+	ips := []net.IP{net.ParseIP(server)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(server); err != nil {
+			return nil, err
+		}
+	}
+
+	var v6, v4 net.IP
+	for _, ip := range ips {
+		switch {
+		case ipFamily(ip) == 4 && v4 == nil:
+			v4 = ip.To4()
+		case ipFamily(ip) == 6 && v6 == nil:
+			v6 = ip
+		}
+	}
+	var targets []net.IP
+	if v6 != nil && family != 4 {
+		targets = append(targets, v6)
+	}
+	if v4 != nil && family != 6 {
+		targets = append(targets, v4)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no IPv%d address for %s", family, server)
+	}
+	return targets, nil
+}
+
+// ipFamily returns 4 or 6.
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+// sendSYN sends the knock spread over a TCP SYN from a raw socket, which
+// needs root or CAP_NET_RAW.
+func sendSYN(srcIP, serverIP net.IP, spaPacket []byte) error {
+	if ipFamily(serverIP) == 6 {
+		return sendSYN6(srcIP, serverIP, spaPacket)
 	}
 
 	// Construct the packet layers
@@ -64,35 +248,28 @@ func sendCmd(serverIPStr, key string) {
 		Protocol: layers.IPProtocolTCP,
 	}
 	tcpLayer := &layers.TCP{
-		SrcPort: layers.TCPPort(12345), // Source port is random
-		DstPort: layers.TCPPort(80),      // Destination port can be anything
-		SYN:     true,
-		Seq:     1105024978, // Needs to be random
-		Window:  14600,
+		SrcPort: layers.TCPPort(32768 + mrand.IntN(28232)), // Random port from the Linux ephemeral range
+		DstPort: layers.TCPPort(80),                        // Destination port can be anything
 	}
 	tcpLayer.SetNetworkLayerForChecksum(ipLayer)
 
-	// Embed the SPA data in TCP options
-	tcpOptions := layers.TCPOption{
-		OptionType:   layers.TCPOptionKindTimestamps,
-		OptionLength: 10, // 2 for kind/length + 8 for timestamps
-		OptionData:   append(make([]byte, 8), spaPacket...),
+	// Spread the SPA data over the IP/TCP headers and options, the rest goes as SYN data
+	synData, err := spa.EncodeSYN(spaPacket, ipLayer, tcpLayer)
+	if err != nil {
+		return fmt.Errorf("failed to encode SYN: %w", err)
 	}
-	tcpLayer.Options = append(tcpLayer.Options, tcpOptions)
 
 	// Serialize the packet
 	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
-	if err := gopacket.SerializeLayers(buf, opts, ipLayer, tcpLayer); err != nil {
-		fmt.Printf("Failed to serialize packet: %v\n", err)
-		os.Exit(1)
+	serOpts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, serOpts, ipLayer, tcpLayer, gopacket.Payload(synData)); err != nil {
+		return fmt.Errorf("failed to serialize packet: %w", err)
 	}
 
 	// Send the packet
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
 	if err != nil {
-		fmt.Printf("Failed to create raw socket: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create raw socket: %w", err)
 	}
 	defer syscall.Close(fd)
 
@@ -102,16 +279,91 @@ func sendCmd(serverIPStr, key string) {
 	copy(addr.Addr[:], serverIP.To4())
 
 	if err := syscall.Sendto(fd, buf.Bytes(), 0, &addr); err != nil {
-		fmt.Printf("Sendto failed: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("sendto failed: %w", err)
 	}
+	return nil
+}
+
+// sendSYN6 sends the knock spread over an IPv6 TCP SYN. IPv6 has no IP ID,
+// so those bytes of the knock move to the SYN data. The kernel adds the
+// IPv6 header, so the socket is bound to srcIP, which the TCP checksum
+// covers.
+func sendSYN6(srcIP, serverIP net.IP, spaPacket []byte) error {
+	ipLayer := &layers.IPv6{
+		SrcIP:      srcIP,
+		DstIP:      serverIP,
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolTCP,
+	}
+	tcpLayer := &layers.TCP{
+		SrcPort: layers.TCPPort(32768 + mrand.IntN(28232)),
+		DstPort: layers.TCPPort(80),
+	}
+	tcpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	synData, err := spa.EncodeSYN(spaPacket, nil, tcpLayer)
+	if err != nil {
+		return fmt.Errorf("failed to encode SYN: %w", err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	serOpts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, serOpts, tcpLayer, gopacket.Payload(synData)); err != nil {
+		return fmt.Errorf("failed to serialize packet: %w", err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err != nil {
+		return fmt.Errorf("failed to create raw socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	var src, dst syscall.SockaddrInet6
+	copy(src.Addr[:], srcIP.To16())
+	copy(dst.Addr[:], serverIP.To16())
+	if err := syscall.Bind(fd, &src); err != nil {
+		return fmt.Errorf("failed to bind raw socket: %w", err)
+	}
+	if err := syscall.Sendto(fd, buf.Bytes(), 0, &dst); err != nil {
+		return fmt.Errorf("sendto failed: %w", err)
+	}
+	return nil
+}
+
+// grantAddress returns the address the knock asks to be granted. An empty
+// source means the local source address, "packet" returns nil to let the
+// server use the packet source. A private local address knocking a public
+// server is behind NAT and would never match the packet source, so it
+// falls back to NAT mode.
+func grantAddress(source string, srcIP, serverIP net.IP) (net.IP, error) {
+	switch source {
+	case "":
+		if !isPublic(srcIP) && isPublic(serverIP) {
+			return nil, nil
+		}
+		return srcIP, nil
+	case sourcePacket:
+		return nil, nil
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address: %s", source)
+	}
+	return ip, nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
 
-	fmt.Println("Knock sent successfully to", serverIPStr)
+// isPublic reports whether ip is a global unicast address outside the
+// private and carrier-grade NAT ranges.
+func isPublic(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
 }
 
 // findSourceAddress finds the local IP address that would be used to connect to the given destination.
-func findSourceAddress(destination string) (net.IP, error) {
-	conn, err := net.Dial("udp", destination+":80")
+func findSourceAddress(destination net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(destination.String(), "80"))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+
+	"knockknock/spa"
+)
+
+func TestGrantAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		srcIP    string
+		serverIP string
+		want     string // empty for NAT mode
+	}{
+		{"public client", "", "198.51.100.7", "203.0.113.10", "198.51.100.7"},
+		{"private client, public server", "", "192.168.1.20", "203.0.113.10", ""},
+		{"CGNAT client, public server", "", "100.64.3.4", "203.0.113.10", ""},
+		{"private client, private server", "", "192.168.1.20", "192.168.1.1", "192.168.1.20"},
+		{"IPv6 client", "", "2001:db8::7", "2001:db8::1", "2001:db8::7"},
+		{"ULA client, public server", "", "fd00::7", "2606:4700::1", ""},
+		{"explicit source", "198.51.100.9", "192.168.1.20", "203.0.113.10", "198.51.100.9"},
+		{"packet source", sourcePacket, "198.51.100.7", "203.0.113.10", ""},
+	}
+	for _, tt := range tests {
+		got, err := grantAddress(tt.source, net.ParseIP(tt.srcIP), net.ParseIP(tt.serverIP))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.want == "" && got != nil || tt.want != "" && !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: grantAddress = %v, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := grantAddress("not-an-ip", nil, nil); err == nil {
+		t.Error("invalid source accepted")
+	}
+}
+
+func TestCreatePacketSignedOTP(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := &credentials{keys: spa.Keys{SignKey: priv}, agentID: spa.KeyID(priv.Public().(ed25519.PublicKey)), mode: spa.ModeSigned}
+	serverIP := net.ParseIP("203.0.113.10")
+	opts := sendOptions{proto: spa.Version3, cipher: "aes-gcm", otpCode: "123456"}
+
+	// Unsealed, the code would travel in clear
+	if _, err := createPacket(creds, serverIP, nil, opts); !errors.Is(err, errClearOTP) {
+		t.Errorf("unsealed signed knock with a code: %v, want errClearOTP", err)
+	}
+
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.serverKey = base64.StdEncoding.EncodeToString(serverKey.PublicKey().Bytes())
+	packet, err := createPacket(creds, serverIP, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := spa.Unseal(serverKey, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knock, err := spa.Decode(spa.Keys{VerifyKey: priv.Public().(ed25519.PublicKey)}, inner)
+	if err != nil || knock.OTP != opts.otpCode {
+		t.Errorf("sealed signed knock = %+v, %v, want OTP %q", knock, err, opts.otpCode)
+	}
+}
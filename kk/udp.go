@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"knockknock/spa"
+)
+
+// Knock transports of kk send.
+const (
+	transportTCP = "tcp" // TCP SYN from a raw socket
+	transportUDP = "udp" // ordinary UDP datagram, no privileges needed
+)
+
+// sendUDP sends the knock as a UDP datagram. Nothing listens on the port;
+// knockd picks the datagram up from its packet capture.
+func sendUDP(serverIP net.IP, port uint16, spaPacket []byte) error {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: serverIP, Port: int(port)})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(spa.EncodeUDP(spaPacket))
+	return err
+}
+
+// knockPort returns the UDP port to knock on: port if set, else the port
+// derived from the master key.
+func knockPort(port int, master []byte) (uint16, error) {
+	switch {
+	case port < 0 || port > 65535:
+		return 0, fmt.Errorf("invalid UDP port: %d", port)
+	case port != 0:
+		return uint16(port), nil
+	case master == nil:
+		return 0, fmt.Errorf("no UDP port for the enrolled key (use -port or set udp_port in kk.toml)")
+	}
+	return spa.KnockPort(master)
+}
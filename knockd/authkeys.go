@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"knockknock/spa"
+)
+
+// AuthorizedKey is a client public key allowed to send signed knocks.
+type AuthorizedKey struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// LoadAuthorizedKeys reads an authorized keys file and indexes it by key ID.
+// Each line has the form "ed25519 <base64 public key> <agent name>"; blank
+// lines and lines starting with # are ignored.
+func LoadAuthorizedKeys(path string) (map[uint64]AuthorizedKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[uint64]AuthorizedKey)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "ed25519" {
+			return nil, fmt.Errorf("%s:%d: expected \"ed25519 <key> <name>\"", path, lineNum)
+		}
+		pub, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid ed25519 public key", path, lineNum)
+		}
+		name := strings.Join(fields[2:], " ")
+
+		id := spa.KeyID(pub)
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key", path, lineNum)
+		}
+		keys[id] = AuthorizedKey{Name: name, Key: pub}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
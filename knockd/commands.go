@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"knockknock/spa"
+)
+
+const commandUsage = `Usage: knockd [command]
+
+Without a command knockd runs the daemon. Commands:
+  agent-key <agent_id>   Print the per-agent key to enroll a client with
+  rotate-key [-overlap <duration>]
+                         Add a new master key to the key ring and retire
+                         the current ones after the overlap (default 720h)
+  revoke <agent_id>      Add an agent to the revocation list
+  unrevoke <agent_id>    Remove an agent from the revocation list
+  revoked                List revoked agents
+  migrate-agent <old_id> <new_id>
+                         Move the records of an agent to a new ID
+  totp <agent_id>        Enroll a new TOTP secret for an agent
+  totp-remove <agent_id> Remove the TOTP secret of an agent
+  server-key [-hybrid] [-not-before <time>] [-epoch <duration>]
+                         Generate an X25519 (or X25519+ML-KEM-768) key for
+                         sealed knocks, valid for one epoch (default 720h)
+
+The database is locked while the daemon runs, so stop knockd before
+changing the revocation list, TOTP secrets or agent IDs.`
+
+// runCommand runs a knockd administration command and exits.
+func runCommand(cfg *Config, args []string) {
+	if err := command(cfg, args); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func command(cfg *Config, args []string) error {
+	switch args[0] {
+	case "agent-key":
+		agentID, err := parseAgentID(args)
+		if err != nil {
+			return err
+		}
+		ring, err := configKeyRing(cfg)
+		if err != nil {
+			return err
+		}
+		current := currentKey(ring, time.Now())
+		if current == nil {
+			return fmt.Errorf("no master key is valid now")
+		}
+		agentKey, err := spa.DeriveAgentKey(current.master, agentID)
+		if err != nil {
+			return err
+		}
+		// Keep the key off the client's command line, where ps and the
+		// shell history would see it
+		fmt.Printf("Agent key: %s\n", base64.StdEncoding.EncodeToString(agentKey))
+		fmt.Println("Run on the client and paste the key at the prompt:")
+		if current.id == 0 {
+			fmt.Printf("  kk enroll -id %d\n", agentID)
+		} else {
+			fmt.Printf("  kk enroll -id %d -key-id %d\n", agentID, current.id)
+		}
+		return nil
+
+	case "rotate-key":
+		rotateFlags := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+		overlap := rotateFlags.Duration("overlap", 30*24*time.Hour, "How long the current keys stay valid")
+		if err := rotateFlags.Parse(args[1:]); err != nil || rotateFlags.NArg() != 0 || *overlap < 0 {
+			return fmt.Errorf("usage: knockd rotate-key [-overlap <duration>]")
+		}
+		kc, retire, err := rotateKey(cfg, configPath, *overlap)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added key %d to %s; the previous keys retire at %s\n", kc.ID, configPath, retire.Format(time.RFC3339))
+		fmt.Println("Restart knockd and move clients to the new key before then. New key:")
+		fmt.Printf("  %s\n", kc.Key)
+		fmt.Println("Store it on each client with 'kk key add <name>' and knock with:")
+		fmt.Printf("  kk send -key-id %d -key-name <name>\n", kc.ID)
+		fmt.Println("or keep it in a file for -key-file, or in KK_KEY, instead of passing it with -k.")
+		fmt.Println("Re-enroll per-agent clients with the output of 'knockd agent-key <agent_id>'.")
+		return nil
+
+	case "revoke", "unrevoke":
+		agentID, err := parseAgentID(args)
+		if err != nil {
+			return err
+		}
+		db, err := NewDB(cfg.DbFile)
+		if err != nil {
+			return fmt.Errorf("failed to open database (is knockd running?): %w", err)
+		}
+		defer db.Close()
+		if args[0] == "revoke" {
+			err = db.Revoke(agentID)
+		} else {
+			err = db.Unrevoke(agentID)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Agent %d %sd\n", agentID, args[0])
+		return nil
+
+	case "revoked":
+		db, err := NewDB(cfg.DbFile)
+		if err != nil {
+			return fmt.Errorf("failed to open database (is knockd running?): %w", err)
+		}
+		defer db.Close()
+		agents, err := db.RevokedAgents()
+		if err != nil {
+			return err
+		}
+		ids := make([]uint64, 0, len(agents))
+		for id := range agents {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			fmt.Printf("%d\trevoked %s\n", id, agents[id].Format(time.RFC3339))
+		}
+		return nil
+
+	case "migrate-agent":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: knockd migrate-agent <old_id> <new_id>")
+		}
+		from, err := parseAgentID(args[:2])
+		if err != nil {
+			return err
+		}
+		to, err := parseAgentID([]string{args[0], args[2]})
+		if err != nil {
+			return err
+		}
+		db, err := NewDB(cfg.DbFile)
+		if err != nil {
+			return fmt.Errorf("failed to open database (is knockd running?): %w", err)
+		}
+		defer db.Close()
+		if err := db.MigrateAgent(from, to); err != nil {
+			return err
+		}
+		fmt.Printf("Agent %d migrated to %d\n", from, to)
+		return nil
+
+	case "totp", "totp-remove":
+		agentID, err := parseAgentID(args)
+		if err != nil {
+			return err
+		}
+		db, err := NewDB(cfg.DbFile)
+		if err != nil {
+			return fmt.Errorf("failed to open database (is knockd running?): %w", err)
+		}
+		defer db.Close()
+		if args[0] == "totp-remove" {
+			if err := db.RemoveTOTPSecret(agentID); err != nil {
+				return err
+			}
+			fmt.Printf("TOTP secret of agent %d removed\n", agentID)
+			return nil
+		}
+		secret, err := newTOTPSecret()
+		if err != nil {
+			return err
+		}
+		if err := db.SetTOTPSecret(agentID, secret); err != nil {
+			return err
+		}
+		fmt.Printf("TOTP secret of agent %d: %s\n", agentID, totpEncoding.EncodeToString(secret))
+		fmt.Println("Add it to an authenticator app, e.g. from this URI:")
+		fmt.Printf("  %s\n", totpURI(secret, agentID))
+		return nil
+
+	case "server-key":
+		keyFlags := flag.NewFlagSet("server-key", flag.ContinueOnError)
+		hybrid := keyFlags.Bool("hybrid", false, "Generate a hybrid X25519+ML-KEM-768 key")
+		notBefore := keyFlags.String("not-before", "", "Start of the epoch, RFC 3339 (default: now)")
+		epoch := keyFlags.Duration("epoch", 30*24*time.Hour, "Length of the epoch; knockd erases the key after it")
+		usage := fmt.Errorf("usage: knockd server-key [-hybrid] [-not-before <time>] [-epoch <duration>]")
+		if err := keyFlags.Parse(args[1:]); err != nil || keyFlags.NArg() != 0 || *epoch <= 0 {
+			return usage
+		}
+		start := time.Now().UTC().Truncate(time.Second)
+		if *notBefore != "" {
+			t, err := time.Parse(time.RFC3339, *notBefore)
+			if err != nil {
+				return usage
+			}
+			start = t.UTC()
+		}
+		end := start.Add(*epoch)
+
+		var priv, pub []byte
+		if *hybrid {
+			key, err := spa.GenerateHybridKey()
+			if err != nil {
+				return err
+			}
+			priv, pub = key.Bytes(), key.PublicKey().Bytes()
+		} else {
+			key, err := ecdh.X25519().GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			priv, pub = key.Bytes(), key.PublicKey().Bytes()
+		}
+		fmt.Printf("Add the private key to knockd.toml; knockd erases it at %s:\n", end.Format(time.RFC3339))
+		printServerKey(base64.StdEncoding.EncodeToString(priv), start, end)
+		fmt.Println("Add the public key to kk.toml on each client; kk seals to the key of the current epoch:")
+		printServerKey(base64.StdEncoding.EncodeToString(pub), start, end)
+		fmt.Println("Generate the key of the next epoch before this one ends, with -not-before set to its end.")
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command: %s\n\n%s", args[0], commandUsage)
+	}
+}
+
+// printServerKey prints a [[server_keys]] entry for knockd.toml or kk.toml.
+func printServerKey(key string, notBefore, notAfter time.Time) {
+	fmt.Println("  [[server_keys]]")
+	fmt.Printf("  key        = %q\n", key)
+	fmt.Printf("  not_before = %s\n", notBefore.Format(time.RFC3339))
+	fmt.Printf("  not_after  = %s\n", notAfter.Format(time.RFC3339))
+}
+
+func parseAgentID(args []string) (uint64, error) {
+	if len(args) != 2 {
+		return 0, fmt.Errorf("usage: knockd %s <agent_id>", args[0])
+	}
+	agentID, err := strconv.ParseUint(args[1], 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid agent ID %q: %w", args[1], err)
+	}
+	return agentID, nil
+}
@@ -3,10 +3,14 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
+// configPath is the path of the knockd configuration file.
+const configPath = "knockd.toml"
+
 type Config struct {
 	Iface       string   `toml:"iface"`
 	AllowPorts  []int    `toml:"allow_ports"`
@@ -14,6 +18,76 @@ type Config struct {
 	MaxTTLMin   int      `toml:"max_ttl_min"`
 	DbFile      string   `toml:"db_file"`
 	Key         string   `toml:"key"`
+
+	// KeyNotAfter retires the top-level key. Keys are the master key ring;
+	// see 'knockd rotate-key'.
+	KeyNotAfter time.Time   `toml:"key_not_after"`
+	Keys        []KeyConfig `toml:"keys"`
+
+	// AcceptV2 keeps accepting legacy v2 knocks during the migration to v3.
+	AcceptV2      bool      `toml:"accept_v2"`
+	AcceptV2Until time.Time `toml:"accept_v2_until"`
+
+	// RequireAgentKeys rejects knocks sealed with the shared master key.
+	RequireAgentKeys bool `toml:"require_agent_keys"`
+
+	// AuthorizedKeys is the path of the Ed25519 authorized keys file for
+	// signed knocks. With it set, key may be left empty.
+	AuthorizedKeys string `toml:"authorized_keys"`
+
+	// ServerKeys are the base64 X25519 or hybrid X25519+ML-KEM-768 private
+	// keys sealed knocks can be encrypted to, each valid for an epoch; see
+	// 'knockd server-key'.
+	ServerKeys    []ServerKeyConfig `toml:"server_keys"`
+	RequireSealed bool              `toml:"require_sealed"`
+	RequireHybrid bool              `toml:"require_hybrid"`
+
+	// ServerID is the identity clients bind their knocks to with
+	// -server-id. Knocks bound to an address are checked against the
+	// interface addresses and ServerAddrs, e.g. the public address of a
+	// server behind NAT.
+	ServerID             string   `toml:"server_id"`
+	ServerAddrs          []string `toml:"server_addrs"`
+	RequireServerBinding bool     `toml:"require_server_binding"`
+
+	// SourceBinding is the policy for the client address in the knock:
+	// "permissive" (default) rejects knocks whose address differs from the
+	// packet source, "strict" also rejects NAT mode and unbound knocks, and
+	// "off" grants the packet source unchecked.
+	SourceBinding string `toml:"source_binding"`
+
+	// Services maps the service names clients can request to their ports.
+	// AgentServices lists the services each agent may request, keyed by
+	// decimal agent ID or authorized keys name; "*" applies to agents that
+	// are not listed. Knocks without services open AllowPorts.
+	Services      map[string][]int    `toml:"services"`
+	AgentServices map[string][]string `toml:"agent_services"`
+
+	// RequireCounter rejects knocks without a per-agent counter.
+	RequireCounter bool `toml:"require_counter"`
+
+	// OTPServices are the services that need a TOTP code from an agent
+	// enrolled with 'knockd totp'. RequireOTP requires it for all knocks.
+	OTPServices []string `toml:"otp_services"`
+	RequireOTP  bool     `toml:"require_otp"`
+
+	// Transports are the ways knocks may arrive: "tcp" (default), "udp",
+	// "icmp" (echo requests) and "dns" (queries for names under
+	// DNSDomain). UDP knocks go to UDPPort, or to the port derived from the
+	// master key if it is 0; no socket is opened for it.
+	Transports []string `toml:"transports"`
+	UDPPort    int      `toml:"udp_port"`
+	DNSDomain  string   `toml:"dns_domain"`
+
+	// IPv6PrefixLen grants IPv6 clients their whole prefix, e.g. 64, so
+	// that privacy addresses keep access. 0 grants the single address.
+	IPv6PrefixLen int `toml:"ipv6_prefix_len"`
+
+	// Firewall is the Linux backend: "iptables" (default, ip6tables for
+	// IPv6) or "nftables", which inserts rules into NFTChain, "inet filter
+	// input" unless set.
+	Firewall string `toml:"firewall"`
+	NFTChain string `toml:"nft_chain"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -1,10 +1,20 @@
-
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
 	"go.etcd.io/bbolt"
 )
 
+var (
+	revokedBucket = []byte("revoked")
+	counterBucket = []byte("counters")
+	totpBucket    = []byte("totp")
+	otpFailBucket = []byte("otp_failures")
+)
+
 // DB is a wrapper around a bbolt database.
 type DB struct {
 	db *bbolt.DB
@@ -12,10 +22,22 @@ type DB struct {
 
 // NewDB creates a new DB.
 func NewDB(path string) (*DB, error) {
-	db, err := bbolt.Open(path, 0600, nil)
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
 	if err != nil {
 		return nil, err
 	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{revokedBucket, counterBucket, totpBucket, otpFailBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	return &DB{db: db}, nil
 }
 
@@ -31,6 +53,155 @@ func (db *DB) IncrementScore(agentID uint64, ip string) error {
 	return nil
 }
 
+// Revoke adds an agent to the revocation list.
+func (db *DB) Revoke(agentID uint64) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		at := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+		return tx.Bucket(revokedBucket).Put(agentKey(agentID), at)
+	})
+}
+
+// Unrevoke removes an agent from the revocation list.
+func (db *DB) Unrevoke(agentID uint64) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(revokedBucket).Delete(agentKey(agentID))
+	})
+}
+
+// IsRevoked reports whether an agent is on the revocation list.
+func (db *DB) IsRevoked(agentID uint64) (bool, error) {
+	var revoked bool
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		revoked = tx.Bucket(revokedBucket).Get(agentKey(agentID)) != nil
+		return nil
+	})
+	return revoked, err
+}
+
+// RevokedAgents returns the revocation list with the time each agent was revoked.
+func (db *DB) RevokedAgents() (map[uint64]time.Time, error) {
+	agents := make(map[uint64]time.Time)
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(revokedBucket).ForEach(func(k, v []byte) error {
+			agents[binary.BigEndian.Uint64(k)] = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			return nil
+		})
+	})
+	return agents, err
+}
+
+// AdvanceCounter records counter as the last knock counter of an agent if it
+// is greater than the one recorded before, and reports whether it was.
+func (db *DB) AdvanceCounter(agentID uint64, counter uint64) (bool, error) {
+	var advanced bool
+	err := db.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(counterBucket)
+		if last := b.Get(agentKey(agentID)); last != nil && counter <= binary.BigEndian.Uint64(last) {
+			return nil
+		}
+		advanced = true
+		return b.Put(agentKey(agentID), binary.BigEndian.AppendUint64(nil, counter))
+	})
+	return advanced, err
+}
+
+// SetTOTPSecret enrolls a TOTP secret for an agent, replacing any previous
+// one and clearing its OTP failures.
+func (db *DB) SetTOTPSecret(agentID uint64, secret []byte) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(otpFailBucket).Delete(agentKey(agentID)); err != nil {
+			return err
+		}
+		return tx.Bucket(totpBucket).Put(agentKey(agentID), secret)
+	})
+}
+
+// RemoveTOTPSecret removes the TOTP secret and the OTP failures of an agent.
+func (db *DB) RemoveTOTPSecret(agentID uint64) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(otpFailBucket).Delete(agentKey(agentID)); err != nil {
+			return err
+		}
+		return tx.Bucket(totpBucket).Delete(agentKey(agentID))
+	})
+}
+
+// OTPFailures returns the number of wrong OTP codes an agent sent in a row
+// and the time of the last one.
+func (db *DB) OTPFailures(agentID uint64) (int, time.Time, error) {
+	var failures int
+	var last time.Time
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(otpFailBucket).Get(agentKey(agentID)); len(v) == 12 {
+			failures = int(binary.BigEndian.Uint32(v))
+			last = time.Unix(int64(binary.BigEndian.Uint64(v[4:])), 0)
+		}
+		return nil
+	})
+	return failures, last, err
+}
+
+// RecordOTPFailure counts a wrong OTP code of an agent sent at now.
+func (db *DB) RecordOTPFailure(agentID uint64, now time.Time) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(otpFailBucket)
+		var failures uint32
+		if v := b.Get(agentKey(agentID)); len(v) == 12 {
+			failures = binary.BigEndian.Uint32(v)
+		}
+		v := binary.BigEndian.AppendUint32(nil, failures+1)
+		v = binary.BigEndian.AppendUint64(v, uint64(now.Unix()))
+		return b.Put(agentKey(agentID), v)
+	})
+}
+
+// ResetOTPFailures clears the OTP failures of an agent.
+func (db *DB) ResetOTPFailures(agentID uint64) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(otpFailBucket).Delete(agentKey(agentID))
+	})
+}
+
+// TOTPSecret returns the TOTP secret of an agent, or nil if none is enrolled.
+func (db *DB) TOTPSecret(agentID uint64) ([]byte, error) {
+	var secret []byte
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(totpBucket).Get(agentKey(agentID)); v != nil {
+			secret = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return secret, err
+}
+
+// MigrateAgent moves every record of agent from to agent to, in all
+// buckets, so that an agent keeps its history under a new ID. Records the
+// new ID already has are kept.
+func (db *DB) MigrateAgent(from, to uint64) error {
+	prefix := agentKey(from)
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bbolt.Bucket) error {
+			var keys [][]byte
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				keys = append(keys, k)
+			}
+			for _, k := range keys {
+				newKey := append(agentKey(to), k[len(prefix):]...)
+				if b.Get(newKey) == nil {
+					if err := b.Put(newKey, append([]byte(nil), b.Get(k)...)); err != nil {
+						return err
+					}
+				}
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
 // Close closes the database.
 func (db *DB) Close() error {
 	if db.db != nil {
@@ -38,3 +209,7 @@ func (db *DB) Close() error {
 	}
 	return nil
 }
+
+func agentKey(agentID uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, agentID)
+}
@@ -11,11 +11,13 @@ import (
 	"time"
 )
 
-// Firewall is an interface for managing firewall rules.
+// Firewall is an interface for managing firewall rules. IPs are IPv4 or
+// IPv6 addresses, or IPv6 prefixes in CIDR notation.
 type Firewall interface {
 	// Add temporarily adds a rule to the firewall for a given IP and ports.
-	// The rule should be automatically deleted after the ttl (in minutes) expires.
-	Add(ip string, ports []int, ttl int) error
+	// The rule is automatically deleted after the ttl (in minutes) expires,
+	// unless the returned timer is stopped first.
+	Add(ip string, ports []int, ttl int) (*time.Timer, error)
 	// Del explicitly removes a firewall rule.
 	Del(ip string, ports []int) error
 	// Cleanup removes all rules managed by this firewall instance.
@@ -23,10 +25,22 @@ type Firewall interface {
 }
 
 // newFirewall creates a new firewall instance based on the operating system.
-func newFirewall(goos string) Firewall {
+func newFirewall(goos string, cfg *Config) Firewall {
 	switch goos {
 	case "linux":
-		log.Println("Using iptables firewall for Linux")
+		switch cfg.Firewall {
+		case "", "iptables":
+		case "nftables":
+			fw, err := newNFTFirewall(cfg.NFTChain)
+			if err != nil {
+				log.Fatalf("Invalid nftables configuration: %v", err)
+			}
+			log.Printf("Using nftables firewall for Linux (chain %s)", strings.Join(fw.chain, " "))
+			return fw
+		default:
+			log.Fatalf("Unsupported firewall for Linux: %s", cfg.Firewall)
+		}
+		log.Println("Using iptables/ip6tables firewall for Linux")
 		return &linuxFirewall{}
 	case "windows":
 		log.Println("Using netsh advfirewall for Windows")
@@ -37,6 +51,27 @@ func newFirewall(goos string) Firewall {
 	}
 }
 
+// parseGrant validates the address of a grant, an IP address or a CIDR
+// prefix, and returns it in canonical form and whether it is IPv6.
+func parseGrant(ip string) (string, bool, error) {
+	if addr := net.ParseIP(ip); addr != nil {
+		return addr.String(), addr.To4() == nil, nil
+	}
+	_, prefix, err := net.ParseCIDR(ip)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid IP address format: %s", ip)
+	}
+	return prefix.String(), prefix.IP.To4() == nil, nil
+}
+
+// iptablesCommand returns the iptables binary for the address family.
+func iptablesCommand(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
 // --- Linux Firewall (iptables) ---
 
 type linuxFirewall struct {
@@ -44,13 +79,13 @@ type linuxFirewall struct {
 	activeIPs map[string]bool
 }
 
-func (f *linuxFirewall) Add(ip string, ports []int, ttl int) error {
+func (f *linuxFirewall) Add(ip string, ports []int, ttl int) (*time.Timer, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	log.Printf("[FIREWALL] Adding rule for IP: %s, Ports: %v, TTL: %d minutes", ip, ports, ttl)
 	if err := f.runIPTables(true, ip, ports); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Track active IP
@@ -60,15 +95,12 @@ func (f *linuxFirewall) Add(ip string, ports []int, ttl int) error {
 	f.activeIPs[ip] = true
 
 	// Schedule the deletion of the rule
-	go func() {
-		time.Sleep(time.Duration(ttl) * time.Minute)
+	return time.AfterFunc(time.Duration(ttl)*time.Minute, func() {
 		log.Printf("[FIREWALL] TTL expired. Deleting rule for IP: %s, Ports: %v", ip, ports)
 		if err := f.Del(ip, ports); err != nil {
 			log.Printf("[FIREWALL] Error deleting expired rule for %s: %v", ip, err)
 		}
-	}()
-
-	return nil
+	}), nil
 }
 
 func (f *linuxFirewall) Del(ip string, ports []int) error {
@@ -92,8 +124,12 @@ func (f *linuxFirewall) Cleanup() error {
 	
 	// Only clean rules we actually created and are tracking
 	for ip := range f.activeIPs {
+		addr, ipv6, err := parseGrant(ip)
+		if err != nil {
+			continue
+		}
 		// Use iptables with comment to identify our rules
-		cmd := exec.Command("iptables", "-L", "INPUT", "--line-numbers")
+		cmd := exec.Command(iptablesCommand(ipv6), "-L", "INPUT", "-n", "--line-numbers")
 		output, err := cmd.Output()
 		if err != nil {
 			log.Printf("[FIREWALL] Error listing rules: %v", err)
@@ -103,13 +139,13 @@ func (f *linuxFirewall) Cleanup() error {
 		// Parse output to find our rules and remove them safely
 		lines := strings.Split(string(output), "\n")
 		for _, line := range lines {
-			if strings.Contains(line, "knockd-allow") && strings.Contains(line, ip) {
+			if strings.Contains(line, "knockd-allow") && strings.Contains(line, addr) {
 				// Extract line number and remove safely
 				fields := strings.Fields(line)
 				if len(fields) > 0 {
 					lineNum := fields[0]
 					if lineNum != "num" && lineNum != "Chain" { // Skip header
-						cmd := exec.Command("iptables", "-D", "INPUT", lineNum)
+						cmd := exec.Command(iptablesCommand(ipv6), "-D", "INPUT", lineNum)
 						if err := cmd.Run(); err != nil {
 							log.Printf("[FIREWALL] Error removing rule %s for %s: %v", lineNum, ip, err)
 						}
@@ -125,9 +161,9 @@ func (f *linuxFirewall) Cleanup() error {
 
 func (f *linuxFirewall) runIPTables(add bool, ip string, ports []int) error {
 	// Validate IP address format
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return fmt.Errorf("invalid IP address format: %s", ip)
+	addr, ipv6, err := parseGrant(ip)
+	if err != nil {
+		return err
 	}
 	
 	// Validate and format ports
@@ -146,12 +182,12 @@ func (f *linuxFirewall) runIPTables(add bool, ip string, ports []int) error {
 		operation = "-I"
 	}
 
-	cmd := exec.Command("iptables", operation, "INPUT", "-s", parsedIP.String(), "-p", "tcp", "-m", "multiport", "--dports", portsStr, "-m", "comment", "--comment", "knockd-allow", "-j", "ACCEPT")
+	cmd := exec.Command(iptablesCommand(ipv6), operation, "INPUT", "-s", addr, "-p", "tcp", "-m", "multiport", "--dports", portsStr, "-m", "comment", "--comment", "knockd-allow", "-j", "ACCEPT")
 	log.Printf("[FIREWALL] Executing: %s", cmd.String())
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("iptables command failed: %s, output: %s", err, string(output))
+		return fmt.Errorf("%s command failed: %s, output: %s", iptablesCommand(ipv6), err, string(output))
 	}
 	return nil
 }
@@ -167,23 +203,23 @@ func (f *windowsFirewall) getRuleName(ip string) string {
 	return fmt.Sprintf("knockd-allow-%s", ip)
 }
 
-func (f *windowsFirewall) Add(ip string, ports []int, ttl int) error {
+func (f *windowsFirewall) Add(ip string, ports []int, ttl int) (*time.Timer, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	log.Printf("[FIREWALL] Adding rule for IP: %s, Ports: %v, TTL: %d minutes", ip, ports, ttl)
 	
 	// Validate IP address format
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return fmt.Errorf("invalid IP address format: %s", ip)
+	addr, _, err := parseGrant(ip)
+	if err != nil {
+		return nil, err
 	}
 	
 	// Validate and format ports
 	var validPorts []string
 	for _, port := range ports {
 		if port < 1 || port > 65535 {
-			return fmt.Errorf("invalid port number: %d", port)
+			return nil, fmt.Errorf("invalid port number: %d", port)
 		}
 		validPorts = append(validPorts, strconv.Itoa(port))
 	}
@@ -193,38 +229,35 @@ func (f *windowsFirewall) Add(ip string, ports []int, ttl int) error {
 	if f.activeIPs == nil {
 		f.activeIPs = make(map[string]bool)
 	}
-	f.activeIPs[parsedIP.String()] = true
+	f.activeIPs[addr] = true
 
 	// On Windows, we first delete any pre-existing rule for this IP to ensure a clean state.
 	_ = f.Del(ip, ports)
 
-	ruleName := f.getRuleName(parsedIP.String())
+	ruleName := f.getRuleName(addr)
 
 	cmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
 		fmt.Sprintf("name=%s", ruleName),
 		"dir=in",
 		"action=allow",
 		"protocol=TCP",
-		fmt.Sprintf("remoteip=%s", parsedIP.String()),
+		fmt.Sprintf("remoteip=%s", addr),
 		fmt.Sprintf("localport=%s", portsStr),
 	)
 	log.Printf("[FIREWALL] Executing: %s", cmd.String())
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("netsh add command failed: %s, output: %s", err, string(output))
+		return nil, fmt.Errorf("netsh add command failed: %s, output: %s", err, string(output))
 	}
 
 	// Schedule the deletion
-	go func() {
-		time.Sleep(time.Duration(ttl) * time.Minute)
+	return time.AfterFunc(time.Duration(ttl)*time.Minute, func() {
 		log.Printf("[FIREWALL] TTL expired. Deleting rule for IP: %s, Ports: %v", ip, ports)
 		if err := f.Del(ip, ports); err != nil {
 			log.Printf("[FIREWALL] Error deleting expired rule for %s: %v", ip, err)
 		}
-	}()
-
-	return nil
+	}), nil
 }
 
 func (f *windowsFirewall) Del(ip string, ports []int) error {
@@ -232,17 +265,17 @@ func (f *windowsFirewall) Del(ip string, ports []int) error {
 	defer f.mu.Unlock()
 
 	// Validate IP address format
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return fmt.Errorf("invalid IP address format: %s", ip)
+	addr, _, err := parseGrant(ip)
+	if err != nil {
+		return err
 	}
 	
 	// Remove from active IPs
 	if f.activeIPs != nil {
-		delete(f.activeIPs, parsedIP.String())
+		delete(f.activeIPs, addr)
 	}
 	
-	ruleName := f.getRuleName(parsedIP.String())
+	ruleName := f.getRuleName(addr)
 	cmd := exec.Command("netsh", "advfirewall", "firewall", "delete", "rule", fmt.Sprintf("name=%s", ruleName))
 	log.Printf("[FIREWALL] Executing: %s", cmd.String())
 
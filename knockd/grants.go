@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// grant is a firewall rule opened for an agent.
+type grant struct {
+	ip      string
+	ports   []int
+	expires time.Time
+	timer   *time.Timer // deletes the rule when the TTL expires
+}
+
+// GrantTable tracks the open grants of each agent so that a close knock can
+// remove them before their TTL expires.
+type GrantTable struct {
+	mu     sync.Mutex
+	grants map[uint64][]grant
+}
+
+// NewGrantTable creates an empty grant table.
+func NewGrantTable() *GrantTable {
+	return &GrantTable{grants: make(map[uint64][]grant)}
+}
+
+// Add records a grant of ports to ip for agentID with a TTL in minutes.
+// timer is the one returned by Firewall.Add.
+func (t *GrantTable) Add(agentID uint64, ip string, ports []int, ttl int, timer *time.Timer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.grants[agentID] = append(t.live(agentID, now), grant{
+		ip:      ip,
+		ports:   ports,
+		expires: now.Add(time.Duration(ttl) * time.Minute),
+		timer:   timer,
+	})
+}
+
+// Take removes and returns the grants of agentID that have not expired
+// yet, stopping their TTL timers so that the caller deletes each rule
+// exactly once. Otherwise a timer would later delete a new grant for the
+// same address and ports.
+func (t *GrantTable) Take(agentID uint64) []grant {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var grants []grant
+	for _, g := range t.live(agentID, time.Now()) {
+		// A timer that already fired has deleted its rule itself
+		if g.timer.Stop() {
+			grants = append(grants, g)
+		}
+	}
+	delete(t.grants, agentID)
+	return grants
+}
+
+// live returns the unexpired grants of agentID. t.mu must be held.
+func (t *GrantTable) live(agentID uint64, now time.Time) []grant {
+	var grants []grant
+	for _, g := range t.grants[agentID] {
+		if now.Before(g.expires) {
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGrantTableTakeStopsTimers(t *testing.T) {
+	// A timer that has already fired and deleted its rule
+	fired := make(chan struct{})
+	expired := time.AfterFunc(0, func() { close(fired) })
+	<-fired
+	live := time.AfterFunc(time.Hour, func() { t.Error("live TTL timer fired") })
+	other := time.AfterFunc(time.Hour, func() { t.Error("TTL timer of another agent fired") })
+	defer other.Stop()
+
+	grants := NewGrantTable()
+	grants.Add(1, "192.0.2.7", []int{22}, 60, live)
+	grants.Add(1, "192.0.2.7", []int{3389}, 60, expired)
+	grants.Add(2, "192.0.2.8", []int{22}, 60, other)
+
+	taken := grants.Take(1)
+	if len(taken) != 1 || taken[0].ports[0] != 22 {
+		t.Fatalf("Take = %+v, want only the grant whose timer has not fired", taken)
+	}
+	// A close knock followed by a new knock: the stopped timer must not
+	// delete the new grant
+	if live.Stop() {
+		t.Error("Take left the TTL timer of a taken grant running")
+	}
+	if taken := grants.Take(1); len(taken) != 0 {
+		t.Errorf("second Take = %+v, want none", taken)
+	}
+
+	if !other.Reset(time.Hour) {
+		t.Error("Take of agent 1 stopped the TTL timer of agent 2")
+	}
+	if taken := grants.Take(2); len(taken) != 1 {
+		t.Errorf("Take of another agent = %+v, want its grant", taken)
+	}
+}
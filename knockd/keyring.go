@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"knockknock/spa"
+)
+
+// KeyConfig is a master key of the key ring in knockd.toml. Keys with an ID
+// let clients name the key in the knock header; the validity window allows
+// old and new keys to overlap during a rotation.
+type KeyConfig struct {
+	ID        uint32    `toml:"id"`
+	Key       string    `toml:"key"`
+	NotBefore time.Time `toml:"not_before"`
+	NotAfter  time.Time `toml:"not_after"`
+}
+
+// ringKey is a decoded master key of the key ring.
+type ringKey struct {
+	id        uint32 // 0 for the legacy key
+	master    []byte
+	keys      spa.Keys
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// validAt reports whether the key may be used at now.
+func (k *ringKey) validAt(now time.Time) bool {
+	return (k.notBefore.IsZero() || !now.Before(k.notBefore)) &&
+		(k.notAfter.IsZero() || now.Before(k.notAfter))
+}
+
+// configKeyRing builds the key ring of cfg, including the top-level key.
+func configKeyRing(cfg *Config) ([]*ringKey, error) {
+	var legacy []byte
+	if cfg.Key != "" {
+		var err error
+		if legacy, err = base64.StdEncoding.DecodeString(cfg.Key); err != nil {
+			return nil, fmt.Errorf("failed to decode master key: %w", err)
+		}
+	}
+	return loadKeyRing(cfg, legacy)
+}
+
+// loadKeyRing builds the key ring from the legacy master key, which may be
+// nil, and the [[keys]] entries of cfg.
+func loadKeyRing(cfg *Config, legacy []byte) ([]*ringKey, error) {
+	var ring []*ringKey
+	if legacy != nil {
+		keys, err := spa.DeriveKeys(legacy)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, &ringKey{master: legacy, keys: keys, notAfter: cfg.KeyNotAfter})
+	}
+
+	seen := make(map[uint32]bool)
+	for _, kc := range cfg.Keys {
+		if kc.ID == 0 || seen[kc.ID] {
+			return nil, fmt.Errorf("key ring IDs must be unique and non-zero, got %d", kc.ID)
+		}
+		seen[kc.ID] = true
+
+		master, err := base64.StdEncoding.DecodeString(kc.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key %d: %w", kc.ID, err)
+		}
+		keys, err := spa.DeriveKeys(master)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d: %w", kc.ID, err)
+		}
+		ring = append(ring, &ringKey{id: kc.ID, master: master, keys: keys, notBefore: kc.NotBefore, notAfter: kc.NotAfter})
+	}
+	return ring, nil
+}
+
+// currentKey returns the newest key of the ring that is valid at now.
+func currentKey(ring []*ringKey, now time.Time) *ringKey {
+	var current *ringKey
+	for _, k := range ring {
+		if k.validAt(now) && (current == nil || !k.notBefore.Before(current.notBefore)) {
+			current = k
+		}
+	}
+	return current
+}
+
+// rotateKey adds a new key to the key ring in the configuration file at
+// path. Keys that are valid now and have no end date retire after overlap,
+// so clients can switch to the new key in the meantime. The file is edited
+// in place to keep its comments and layout.
+func rotateKey(cfg *Config, path string, overlap time.Duration) (KeyConfig, time.Time, error) {
+	ring, err := configKeyRing(cfg)
+	if err != nil {
+		return KeyConfig{}, time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return KeyConfig{}, time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return KeyConfig{}, time.Time{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	retire := now.Add(overlap)
+	var id uint32
+	for _, k := range ring {
+		id = max(id, k.id)
+	}
+	id++
+
+	key := make([]byte, spa.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return KeyConfig{}, time.Time{}, err
+	}
+
+	// Walk the file, tracking which [[keys]] entry each line belongs to.
+	// The top-level key gets key_not_after below its key line, ring keys
+	// not_after below their [[keys]] header.
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	var out []string
+	entry, topLevel := -1, true
+	for _, line := range lines {
+		out = append(out, line)
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "[[keys]]":
+			topLevel = false
+			entry++
+			if entry < len(cfg.Keys) && cfg.Keys[entry].NotAfter.IsZero() && !cfg.Keys[entry].NotBefore.After(now) {
+				out = append(out, "not_after = "+retire.Format(time.RFC3339))
+			}
+		case strings.HasPrefix(trimmed, "["):
+			topLevel = false
+		case topLevel && cfg.Key != "" && cfg.KeyNotAfter.IsZero() && isKeyLine(trimmed, "key"):
+			out = append(out, "key_not_after = "+retire.Format(time.RFC3339))
+		}
+	}
+	kc := KeyConfig{ID: id, Key: base64.StdEncoding.EncodeToString(key), NotBefore: now}
+	out = append(out, "",
+		"[[keys]]",
+		fmt.Sprintf("id = %d", kc.ID),
+		fmt.Sprintf("key = %q", kc.Key),
+		"not_before = "+kc.NotBefore.Format(time.RFC3339),
+	)
+
+	if err := replaceFile(path, []byte(strings.Join(out, "\n")+"\n"), info.Mode().Perm()); err != nil {
+		return KeyConfig{}, time.Time{}, err
+	}
+	return kc, retire, nil
+}
+
+// replaceFile writes data to a temporary file next to path and renames it
+// over path, so that a crash or a full disk never leaves path truncated.
+// The new file gets mode perm.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly after the rename
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// isKeyLine reports whether the TOML line assigns name.
+func isKeyLine(line, name string) bool {
+	rest, ok := strings.CutPrefix(line, name)
+	return ok && strings.HasPrefix(strings.TrimSpace(rest), "=")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rotateConfig = `# knockd configuration
+key = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=" # legacy key
+allow_ports = [22]
+
+[services]
+ssh = [22]
+
+[[keys]]
+# first ring key
+id = 1
+key = "ICEiIyQlJicoKSorLC0uLzAxMjM0NTY3ODk6Ozw9Pj8="
+
+[[keys]]
+id = 2
+key = "QEFCQ0RFRkdISUpLTE1OT1BRUlNUVVZXWFlaW1xdXl8="
+not_after = 2030-01-01T00:00:00Z
+`
+
+func TestRotateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knockd.toml")
+	if err := os.WriteFile(path, []byte(rotateConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A mode other than the temporary file's, which must carry over
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kc, retire, err := rotateKey(cfg, path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kc.ID != 3 {
+		t.Errorf("new key ID = %d, want 3", kc.ID)
+	}
+	if d := time.Until(retire); d < 23*time.Hour || d > 25*time.Hour {
+		t.Errorf("retire = %s, want about a day from now", retire)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every original line, comments included, is kept in order
+	rest := string(data)
+	for _, line := range strings.Split(strings.TrimSpace(rotateConfig), "\n") {
+		i := strings.Index(rest, line+"\n")
+		if i < 0 {
+			t.Fatalf("rotated file lost or moved line %q:\n%s", line, data)
+		}
+		rest = rest[i+len(line):]
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("rotated file mode = %v, want 0640", info.Mode().Perm())
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Errorf("%d files left next to the rotated file, want 1 (%v)", len(entries), err)
+	}
+
+	rotated, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("rotated file does not parse: %v\n%s", err, data)
+	}
+	if !rotated.KeyNotAfter.Equal(retire) {
+		t.Errorf("key_not_after = %s, want %s", rotated.KeyNotAfter, retire)
+	}
+	if len(rotated.Keys) != 3 {
+		t.Fatalf("got %d ring keys, want 3", len(rotated.Keys))
+	}
+	if !rotated.Keys[0].NotAfter.Equal(retire) {
+		t.Errorf("key 1 not_after = %s, want %s", rotated.Keys[0].NotAfter, retire)
+	}
+	if want := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC); !rotated.Keys[1].NotAfter.Equal(want) {
+		t.Errorf("key 2 not_after = %s, want it unchanged", rotated.Keys[1].NotAfter)
+	}
+	if rotated.Keys[2] != kc {
+		t.Errorf("new key = %+v, want %+v", rotated.Keys[2], kc)
+	}
+	if rotated.Services["ssh"] == nil {
+		t.Error("rotated file lost the services table")
+	}
+
+	ring, err := configKeyRing(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current := currentKey(ring, time.Now()); current == nil || current.id != 3 {
+		t.Errorf("current key = %+v, want key 3", current)
+	}
+	if current := currentKey(ring, retire.Add(time.Second)); current == nil || current.id != 3 {
+		t.Errorf("current key after retirement = %+v, want key 3", current)
+	}
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"log"
 	"os"
@@ -12,44 +10,43 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/google/gopacket/layers"
+	"knockknock/spa"
 )
 
-func deriveKeys(masterKey []byte) ([]byte, []byte) {
-	hmacE := hmac.New(sha256.New, masterKey)
-	hmacE.Write([]byte("knockknock-encrypt"))
-	keyE := hmacE.Sum(nil)
-
-	hmacH := hmac.New(sha256.New, masterKey)
-	hmacH.Write([]byte("knockknock-hmac"))
-	keyH := hmacH.Sum(nil)
-
-	return keyE, keyH
-}
-
 func main() {
-	cfg, err := LoadConfig("knockd.toml")
+	cfg, err := LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if len(os.Args) > 1 {
+		runCommand(cfg, os.Args[1:])
+		return
+	}
+
 	var masterKey []byte
-	if cfg.Key == "" {
-		log.Println("Master key not found in config, generating a new one...")
-		key := make([]byte, 32)
-		if _, err := rand.Read(key); err != nil {
-			log.Fatalf("Failed to generate new key: %v", err)
+	if cfg.Key == "" && len(cfg.Keys) > 0 {
+		log.Printf("Using a key ring of %d keys", len(cfg.Keys))
+	} else if cfg.Key == "" && cfg.AuthorizedKeys != "" {
+		log.Println("No master key configured, accepting signed knocks only")
+	} else {
+		if cfg.Key == "" {
+			log.Println("Master key not found in config, generating a new one...")
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				log.Fatalf("Failed to generate new key: %v", err)
+			}
+			cfg.Key = base64.StdEncoding.EncodeToString(key)
+			log.Println("Please add the following line to your knockd.toml file:")
+			log.Printf(`key = "%s"`, cfg.Key)
+		}
+		masterKey, err = base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			log.Fatalf("Failed to decode master key: %v", err)
+		}
+		if len(masterKey) != spa.KeySize {
+			log.Fatalf("Invalid master key length: expected %d bytes, got %d", spa.KeySize, len(masterKey))
 		}
-		cfg.Key = base64.StdEncoding.EncodeToString(key)
-		log.Println("Please add the following line to your knockd.toml file:")
-		log.Printf(`key = "%s"`, cfg.Key)
-	}
-	masterKey, err = base64.StdEncoding.DecodeString(cfg.Key)
-	if err != nil {
-		log.Fatalf("Failed to decode master key: %v", err)
-	}
-	if len(masterKey) != 32 {
-		log.Fatalf("Invalid master key length: expected 32 bytes, got %d", len(masterKey))
 	}
 
 	if cfg.Iface == "" {
@@ -61,9 +58,7 @@ func main() {
 		log.Printf("Automatically selected interface: %s", cfg.Iface)
 	}
 
-	keyE, keyH := deriveKeys(masterKey)
-
-	fw := newFirewall(runtime.GOOS)
+	fw := newFirewall(runtime.GOOS, cfg)
 	defer func() {
 		log.Println("[MAIN] Cleaning up firewall rules...")
 		if err := fw.Cleanup(); err != nil {
@@ -88,8 +83,27 @@ func main() {
 	}()
 
 	ttlEngine := NewTTLEngine(cfg.BaseTTLMin, cfg.MaxTTLMin, db)
+	grants := NewGrantTable()
 
+	// Expired server keys are erased at startup and when their epoch ends
+	eraseServerKeys(cfg, time.Now())
 	nonceStore := NewNonceStore(time.Minute)
+	verifier, err := NewVerifier(cfg, masterKey, nonceStore, db)
+	if err != nil {
+		log.Fatalf("Failed to create verifier: %v", err)
+	}
+	transports, err := NewTransports(cfg, verifier.ring)
+	if err != nil {
+		log.Fatalf("Failed to set up transports: %v", err)
+	}
+	log.Printf("Accepting knocks over %s", transports)
+	if cfg.AcceptV2 {
+		if cfg.AcceptV2Until.IsZero() {
+			log.Println("Accepting legacy v2 knocks")
+		} else {
+			log.Printf("Accepting legacy v2 knocks until %s", cfg.AcceptV2Until.Format(time.RFC3339))
+		}
+	}
 
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -97,6 +111,9 @@ func main() {
 
 	log.Println("knockd is running...")
 
+	expiry := time.NewTicker(time.Minute)
+	defer expiry.Stop()
+
 	// Main packet processing loop
 	for {
 		select {
@@ -106,35 +123,57 @@ func main() {
 				return
 			}
 
-			ipLayer := pkt.Layer(layers.LayerTypeIPv4)
-			if ipLayer == nil {
+			packet, src, ok := transports.Knock(pkt)
+			if !ok {
 				continue
 			}
-			ip, ok := ipLayer.(*layers.IPv4)
+
+			info, ok := verifier.Verify(packet, src)
 			if !ok {
-				log.Printf("Failed to assert IPv4 layer from packet")
 				continue
 			}
 
-			info, ok := Verify(pkt.Data(), keyE, keyH, nonceStore)
-			if !ok {
+			if info.Close {
+				closed := grants.Take(info.AgentID)
+				for _, g := range closed {
+					if err := fw.Del(g.ip, g.ports); err != nil {
+						log.Printf("Failed to delete firewall rule for %s: %v", g.ip, err)
+					}
+				}
+				log.Printf("Closed %d grant(s) of agent %d%s on request from %s", len(closed), info.AgentID, info.nameSuffix(), info.IP)
 				continue
 			}
-			info.IP = ip.SrcIP.String()
 
-			ttl := ttlEngine.Next(info.AgentID, info.IP)
-			if err := fw.Add(info.IP, cfg.AllowPorts, ttl); err != nil {
+			ttl := ttlEngine.Grant(info.AgentID, info.IP, info.TTL)
+			if timer, err := fw.Add(info.IP, info.Ports, ttl); err != nil {
 				log.Printf("Failed to add firewall rule for %s: %v", info.IP, err)
 			} else {
-				log.Printf("Added firewall rule for %s with TTL %d minutes", info.IP, ttl)
+				grants.Add(info.AgentID, info.IP, info.Ports, ttl, timer)
+				log.Printf("Added firewall rule for %s ports %v (agent %d%s, v%d%s) with TTL %d minutes%s", info.IP, info.Ports, info.AgentID, info.nameSuffix(), info.Version, info.servicesSuffix(), ttl, info.ttlSuffix())
 			}
 			if err := db.IncrementScore(info.AgentID, info.IP); err != nil {
 				log.Printf("Failed to increment score for agent %d, IP %s: %v", info.AgentID, info.IP, err)
 			}
 
+		case now := <-expiry.C:
+			verifier.expireServerKeys(now)
+			eraseServerKeys(cfg, now)
+
 		case sig := <-sigChan:
 			log.Printf("Received signal %v, shutting down gracefully...", sig)
 			return
 		}
 	}
 }
+
+// eraseServerKeys removes the server keys whose epoch has ended at now from
+// the configuration file. Entries it fails to remove are retried on the next
+// call.
+func eraseServerKeys(cfg *Config, now time.Time) {
+	n, err := eraseExpiredServerKeys(cfg, configPath, now)
+	if err != nil {
+		log.Printf("[MAIN] Failed to erase expired server keys from %s: %v", configPath, err)
+	} else if n > 0 {
+		log.Printf("[MAIN] Erased %d expired server key(s) from %s", n, configPath)
+	}
+}
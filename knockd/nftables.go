@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultNFTChain is the chain grants are inserted into. A chain of an inet
+// table filters IPv4 and IPv6 alike.
+const defaultNFTChain = "inet filter input"
+
+// nftHandle matches the rule handle printed by 'nft --echo --handle'.
+var nftHandle = regexp.MustCompile(`# handle (\d+)`)
+
+// --- Linux Firewall (nftables) ---
+
+// nftFirewall inserts accept rules into an existing nftables chain, the
+// one holding the drop policy, since an accept in a separate table would
+// not override it. Rules are removed by handle.
+type nftFirewall struct {
+	chain []string // family, table and chain
+
+	mu      sync.Mutex
+	handles map[string][]string // rule handles by address and ports
+}
+
+// newNFTFirewall creates an nftables firewall for chain, given as
+// "<family> <table> <chain>".
+func newNFTFirewall(chain string) (*nftFirewall, error) {
+	if chain == "" {
+		chain = defaultNFTChain
+	}
+	fields := strings.Fields(chain)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("nft_chain must be \"<family> <table> <chain>\", got %q", chain)
+	}
+	return &nftFirewall{chain: fields, handles: make(map[string][]string)}, nil
+}
+
+func (f *nftFirewall) Add(ip string, ports []int, ttl int) (*time.Timer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	log.Printf("[FIREWALL] Adding rule for IP: %s, Ports: %v, TTL: %d minutes", ip, ports, ttl)
+	addr, ipv6, err := parseGrant(ip)
+	if err != nil {
+		return nil, err
+	}
+	portsStr, err := nftPorts(ports)
+	if err != nil {
+		return nil, err
+	}
+
+	saddr := "ip"
+	if ipv6 {
+		saddr = "ip6"
+	}
+	args := append([]string{"--echo", "--handle", "insert", "rule"}, f.chain...)
+	args = append(args, saddr, "saddr", addr, "tcp", "dport", "{", portsStr, "}", "accept", "comment", `"knockd-allow"`)
+	output, err := f.run(args...)
+	if err != nil {
+		return nil, err
+	}
+	m := nftHandle.FindStringSubmatch(output)
+	if m == nil {
+		return nil, fmt.Errorf("no rule handle in nft output: %s", output)
+	}
+	key := addr + " " + portsStr
+	f.handles[key] = append(f.handles[key], m[1])
+
+	// Schedule the deletion of the rule
+	return time.AfterFunc(time.Duration(ttl)*time.Minute, func() {
+		log.Printf("[FIREWALL] TTL expired. Deleting rule for IP: %s, Ports: %v", ip, ports)
+		if err := f.Del(ip, ports); err != nil {
+			log.Printf("[FIREWALL] Error deleting expired rule for %s: %v", ip, err)
+		}
+	}), nil
+}
+
+// Del removes one rule for ip and ports, like iptables -D.
+func (f *nftFirewall) Del(ip string, ports []int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	addr, _, err := parseGrant(ip)
+	if err != nil {
+		return err
+	}
+	portsStr, err := nftPorts(ports)
+	if err != nil {
+		return err
+	}
+	key := addr + " " + portsStr
+	handles := f.handles[key]
+	if len(handles) == 0 {
+		return fmt.Errorf("no nftables rule for %s ports %s", addr, portsStr)
+	}
+	handle := handles[len(handles)-1]
+	if len(handles) == 1 {
+		delete(f.handles, key)
+	} else {
+		f.handles[key] = handles[:len(handles)-1]
+	}
+	return f.deleteRule(handle)
+}
+
+// Cleanup removes all rules inserted by this instance.
+func (f *nftFirewall) Cleanup() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	log.Println("[FIREWALL] Cleaning up knockd-managed firewall rules...")
+	for key, handles := range f.handles {
+		for _, handle := range handles {
+			if err := f.deleteRule(handle); err != nil {
+				log.Printf("[FIREWALL] Error removing rule for %s: %v", key, err)
+			}
+		}
+	}
+	f.handles = make(map[string][]string)
+	return nil
+}
+
+func (f *nftFirewall) deleteRule(handle string) error {
+	args := append(append([]string{"delete", "rule"}, f.chain...), "handle", handle)
+	_, err := f.run(args...)
+	return err
+}
+
+func (f *nftFirewall) run(args ...string) (string, error) {
+	cmd := exec.Command("nft", args...)
+	log.Printf("[FIREWALL] Executing: %s", cmd.String())
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("nft command failed: %s, output: %s", err, string(output))
+	}
+	return string(output), nil
+}
+
+// nftPorts validates ports and formats them as set elements.
+func nftPorts(ports []int) (string, error) {
+	var validPorts []string
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return "", fmt.Errorf("invalid port number: %d", port)
+		}
+		validPorts = append(validPorts, strconv.Itoa(port))
+	}
+	if len(validPorts) == 0 {
+		return "", fmt.Errorf("no ports to open")
+	}
+	return strings.Join(validPorts, ","), nil
+}
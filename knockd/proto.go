@@ -1,110 +1,544 @@
-
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"knockknock/spa"
 )
 
 const (
-	protocolVersion = 0x02
-	validTimeWindow = 30 // seconds
+	validTimeWindow = 30 * time.Second
 )
 
-// SPAInfo holds the decoded information from a valid SPA packet.
+// Source binding policies.
+const (
+	sourceBindingOff        = "off"
+	sourceBindingPermissive = "permissive"
+	sourceBindingStrict     = "strict"
+)
 
+// SPAInfo holds the decoded information from a valid SPA packet.
 type SPAInfo struct {
-	AgentID uint64
-	IP      string
+	AgentID  uint64
+	Name     string // signed knocks only
+	Version  byte
+	IP       string        // address to grant
+	Services []string      // requested services, if any
+	Ports    []int         // ports to open
+	TTL      time.Duration // requested grant duration, 0 if none
+	Close    bool          // revoke the agent's grants instead
+}
+
+// nameSuffix formats the agent name for log messages.
+func (info *SPAInfo) nameSuffix() string {
+	if info.Name == "" {
+		return ""
+	}
+	return " " + strconv.Quote(info.Name)
+}
+
+// servicesSuffix formats the requested services for log messages.
+func (info *SPAInfo) servicesSuffix() string {
+	if len(info.Services) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(info.Services, ",")
+}
+
+// ttlSuffix formats the requested TTL for log messages.
+func (info *SPAInfo) ttlSuffix() string {
+	if info.TTL == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", requested %s", info.TTL)
 }
 
-// Verify checks if a packet is a valid SPA packet.
-func Verify(packetData []byte, keyE, keyH []byte, nonceStore *NonceStore) (*SPAInfo, bool) {
-	// Enhanced bounds checking to prevent buffer overflow
-	const minPacketSize = 61 // 1(version) + 4(timestamp) + 8(agentID) + 16(nonce) + 16(MAC) + 16(IV)
-	if len(packetData) < minPacketSize {
+// Verifier checks knocks against the server keys and protocol policy.
+type Verifier struct {
+	ring             []*ringKey
+	nonceStore       *NonceStore
+	db               *DB
+	acceptV2         bool
+	acceptV2Until    time.Time
+	requireAgentKeys bool
+	authorizedKeys   map[uint64]AuthorizedKey
+	serverKeys       map[uint64]*serverKey
+	requireSealed    bool
+	requireHybrid    bool
+	serverID         string
+	serverAddrs      []net.IP
+	requireBinding   bool
+	sourceBinding    string
+	allowPorts       []int
+	services         map[string][]int
+	agentServices    map[string][]string
+	requireCounter   bool
+	otpPorts         []int
+	requireOTP       bool
+	ipv6PrefixLen    int
+}
+
+// NewVerifier creates a new verifier. Legacy v2 knocks are only accepted
+// when enabled in cfg, and only until cfg.AcceptV2Until if that is set.
+// masterKey is the top-level key of the key ring and may be nil.
+func NewVerifier(cfg *Config, masterKey []byte, nonceStore *NonceStore, db *DB) (*Verifier, error) {
+	ring, err := loadKeyRing(cfg, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var authorizedKeys map[uint64]AuthorizedKey
+	if cfg.AuthorizedKeys != "" {
+		var err error
+		if authorizedKeys, err = LoadAuthorizedKeys(cfg.AuthorizedKeys); err != nil {
+			return nil, fmt.Errorf("failed to load authorized keys: %w", err)
+		}
+	}
+
+	serverKeys, err := loadServerKeys(cfg, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var serverAddrs []net.IP
+	for _, s := range cfg.ServerAddrs {
+		addr := net.ParseIP(s)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid server address: %s", s)
+		}
+		serverAddrs = append(serverAddrs, addr)
+	}
+
+	sourceBinding := cfg.SourceBinding
+	switch sourceBinding {
+	case "":
+		sourceBinding = sourceBindingPermissive
+	case sourceBindingOff, sourceBindingPermissive, sourceBindingStrict:
+	default:
+		return nil, fmt.Errorf("invalid source_binding: %s", sourceBinding)
+	}
+
+	if cfg.IPv6PrefixLen < 0 || cfg.IPv6PrefixLen > 128 {
+		return nil, fmt.Errorf("invalid ipv6_prefix_len: %d", cfg.IPv6PrefixLen)
+	}
+
+	var otpPorts []int
+	for _, name := range cfg.OTPServices {
+		ports, ok := cfg.Services[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown service %q in otp_services", name)
+		}
+		otpPorts = append(otpPorts, ports...)
+	}
+	for agent, names := range cfg.AgentServices {
+		for _, name := range names {
+			if _, ok := cfg.Services[name]; !ok {
+				return nil, fmt.Errorf("unknown service %q for agent %s", name, agent)
+			}
+		}
+	}
+
+	return &Verifier{
+		ring:             ring,
+		nonceStore:       nonceStore,
+		db:               db,
+		acceptV2:         cfg.AcceptV2,
+		acceptV2Until:    cfg.AcceptV2Until,
+		requireAgentKeys: cfg.RequireAgentKeys,
+		authorizedKeys:   authorizedKeys,
+		serverKeys:       serverKeys,
+		requireSealed:    cfg.RequireSealed,
+		requireHybrid:    cfg.RequireHybrid,
+		serverID:         cfg.ServerID,
+		serverAddrs:      serverAddrs,
+		requireBinding:   cfg.RequireServerBinding,
+		sourceBinding:    sourceBinding,
+		allowPorts:       cfg.AllowPorts,
+		services:         cfg.Services,
+		agentServices:    cfg.AgentServices,
+		requireCounter:   cfg.RequireCounter,
+		otpPorts:         otpPorts,
+		requireOTP:       cfg.RequireOTP,
+		ipv6PrefixLen:    cfg.IPv6PrefixLen,
+	}, nil
+}
+
+// Verify checks if packet, an encoded knock received from src, is valid.
+// src is nil for knocks relayed by a third party, such as a DNS resolver;
+// they are granted to the client address in the knock.
+func (v *Verifier) Verify(packet []byte, src net.IP) (*SPAInfo, bool) {
+	now := time.Now()
+	packet, sealed, ok := v.unseal(packet, now)
+	if !ok {
 		return nil, false
 	}
 
-	// Ensure we don't access out of bounds
-	dataLen := len(packetData)
-	if dataLen < 32+16 { // Need at least MAC + IV
+	candidates, name := v.keysFor(packet, now)
+	var knock *spa.Knock
+	for _, keys := range candidates {
+		var err error
+		if knock, err = spa.Decode(keys, packet); err == nil {
+			break
+		}
+	}
+	if knock == nil {
 		return nil, false
 	}
 
-	// Extract components with bounds checking
-	ivStart := dataLen - 16
-	macStart := dataLen - 32
-	
-	if ivStart < 0 || macStart < 0 || macStart >= ivStart {
+	if !v.versionAllowed(knock.Version, now) {
+		log.Printf("[SPA] Rejected v%d knock from agent %d: version not accepted", knock.Version, knock.AgentID)
 		return nil, false
 	}
-	
-	iv := packetData[ivStart:]
-	mac := packetData[macStart:ivStart]
-	cipherText := packetData[:macStart]
-	
-	if len(cipherText) < 29 { // Minimum plaintext size (increased from 21 to 29)
+
+	if !v.boundHere(knock) {
+		log.Printf("[SPA] Rejected knock from agent %d: not bound to this server", knock.AgentID)
 		return nil, false
 	}
 
-	// Verify MAC
-	expectedMAC := hmac.New(sha256.New, keyH)
-	expectedMAC.Write(cipherText)
-	expectedMACSum := expectedMAC.Sum(nil)
-	if len(expectedMACSum) < 16 {
+	if src == nil && knock.ClientAddr == nil {
+		log.Printf("[SPA] Rejected relayed knock from agent %d: no client address in the knock", knock.AgentID)
 		return nil, false
 	}
-	
-	if !hmac.Equal(mac, expectedMACSum[:16]) {
+	if src != nil && !v.sourceAllowed(knock, src) {
+		log.Printf("[SPA] Rejected knock from agent %d: source %s not authenticated by the knock", knock.AgentID, src)
 		return nil, false
 	}
 
-	// Decrypt plaintext
-	block, err := aes.NewCipher(keyE)
-	if err != nil {
+	ports, ok := v.portsFor(knock, name)
+	if !ok {
+		log.Printf("[SPA] Rejected knock from agent %d: services %v not allowed", knock.AgentID, knock.Services)
 		return nil, false
 	}
-	stream := cipher.NewCTR(block, iv)
-	plainText := make([]byte, len(cipherText))
-	stream.XORKeyStream(plainText, cipherText)
 
-	// Parse plaintext with additional validation
-	if len(plainText) < 29 {
+	if err := knock.CheckTime(now, validTimeWindow); err != nil {
 		return nil, false
 	}
-	
-	if plainText[0] != protocolVersion {
+
+	revoked, err := v.db.IsRevoked(knock.AgentID)
+	if err != nil {
+		log.Printf("[SPA] Failed to check revocation for agent %d: %v", knock.AgentID, err)
+		return nil, false
+	}
+	if revoked {
+		log.Printf("[SPA] Rejected knock from revoked agent %d", knock.AgentID)
 		return nil, false
 	}
 
-	timestamp := binary.BigEndian.Uint32(plainText[1:5])
-	now := time.Now().Unix()
-	packetTime := int64(timestamp)
-	
-	// Prevent integer overflow in timestamp comparison
-	if packetTime < 0 || now < 0 {
+	if !v.nonceStore.IsValid(knock.Nonce[:]) {
+		return nil, false // Replay attack detected
+	}
+
+	if !v.counterValid(knock) {
 		return nil, false
 	}
-	
-	if now-packetTime > validTimeWindow || packetTime-now > validTimeWindow {
+
+	// Last, so that only fresh knocks count as OTP failures
+	if !v.otpValid(knock, sealed, ports, now) {
 		return nil, false
 	}
 
-	agentID := binary.BigEndian.Uint64(plainText[5:13])
-	nonce16 := plainText[13:29] // 16-byte nonce
+	grant := src
+	if grant == nil {
+		grant = knock.ClientAddr
+	}
+	return &SPAInfo{AgentID: knock.AgentID, Name: name, Version: knock.Version, IP: v.grantAddr(grant), Services: knock.Services, Ports: ports, TTL: knock.TTL, Close: knock.Close}, true
+}
 
-	if !nonceStore.IsValid(nonce16) {
-		return nil, false // Replay attack detected
+// grantAddr returns the address to open the firewall for: ip itself, or
+// its prefix for IPv6 clients when ipv6_prefix_len is set.
+func (v *Verifier) grantAddr(ip net.IP) string {
+	if ip.To4() != nil || v.ipv6PrefixLen == 0 {
+		return ip.String()
+	}
+	mask := net.CIDRMask(v.ipv6PrefixLen, 128)
+	prefix := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return prefix.String()
+}
+
+// unseal opens a sealed or hybrid envelope and returns the inner knock and
+// whether it was sealed. Other knocks are returned unchanged unless
+// envelopes are required. Envelopes are only opened with server keys whose
+// epoch includes now.
+func (v *Verifier) unseal(packet []byte, now time.Time) ([]byte, bool, bool) {
+	h, err := spa.PeekHeader(packet)
+	if err != nil {
+		return packet, false, !v.requireSealed && !v.requireHybrid
 	}
 
-	// For now, we'll extract the IP from the packet data itself.
-	// This will be improved in the sniffer implementation.
-	srcIP := "127.0.0.1" // Placeholder
+	switch h.Mode {
+	case spa.ModeSealed:
+		key, ok := v.serverKeys[h.ServerKeyID]
+		if !ok || key.x25519 == nil || !key.validAt(now) || v.requireHybrid {
+			return nil, false, false
+		}
+		inner, err := spa.Unseal(key.x25519, packet)
+		return inner, true, err == nil
+	case spa.ModeHybrid:
+		key, ok := v.serverKeys[h.ServerKeyID]
+		if !ok || key.hybrid == nil || !key.validAt(now) {
+			return nil, false, false
+		}
+		inner, err := spa.UnsealHybrid(key.hybrid, packet)
+		return inner, true, err == nil
+	default:
+		return packet, false, !v.requireSealed && !v.requireHybrid
+	}
+}
+
+// expireServerKeys drops the server keys whose epoch has ended at now, so
+// that knockd no longer holds their private keys.
+func (v *Verifier) expireServerKeys(now time.Time) {
+	for id, key := range v.serverKeys {
+		if !key.notAfter.IsZero() && !now.Before(key.notAfter) {
+			delete(v.serverKeys, id)
+		}
+	}
+}
 
-	return &SPAInfo{AgentID: agentID, IP: srcIP}, true
+// boundHere reports whether the server binding of knock names this server.
+// Unbound knocks are accepted unless a binding is required.
+func (v *Verifier) boundHere(knock *spa.Knock) bool {
+	if knock.ServerID == "" && knock.ServerAddr == nil {
+		return !v.requireBinding
+	}
+	if knock.ServerID != "" && knock.ServerID != v.serverID {
+		return false
+	}
+	if knock.ServerAddr != nil && !v.isLocalAddr(knock.ServerAddr) {
+		return false
+	}
+	return true
+}
+
+// sourceAllowed applies the source binding policy to a knock seen from src.
+func (v *Verifier) sourceAllowed(knock *spa.Knock, src net.IP) bool {
+	switch {
+	case v.sourceBinding == sourceBindingOff:
+		return true
+	case knock.ClientAddr != nil:
+		return knock.ClientAddr.Equal(src)
+	default:
+		// NAT mode or a knock without a client address
+		return v.sourceBinding != sourceBindingStrict
+	}
+}
+
+// portsFor returns the ports to open for knock. It fails if the knock asks
+// for a service the agent may not request. A knock without services opens
+// allow_ports, or only the agent's services if [agent_services] limits it.
+func (v *Verifier) portsFor(knock *spa.Knock, name string) ([]int, bool) {
+	allowed, limited := v.allowedServices(knock.AgentID, name)
+	requested := knock.Services
+	if len(requested) == 0 {
+		if !limited {
+			return v.allowPorts, true
+		}
+		requested = allowed
+	}
+
+	var ports []int
+	for _, service := range requested {
+		if !slices.Contains(allowed, service) {
+			return nil, false
+		}
+		ports = append(ports, v.services[service]...)
+	}
+	slices.Sort(ports)
+	return slices.Compact(ports), len(ports) > 0
+}
+
+// allowedServices returns the services an agent may request, looked up by
+// agent ID, then by name, then the "*" default, and whether an entry
+// matched at all.
+func (v *Verifier) allowedServices(agentID uint64, name string) ([]string, bool) {
+	if services, ok := v.agentServices[strconv.FormatUint(agentID, 10)]; ok {
+		return services, true
+	}
+	if services, ok := v.agentServices[name]; ok && name != "" {
+		return services, true
+	}
+	services, ok := v.agentServices["*"]
+	return services, ok
+}
+
+// counterValid checks and records the per-agent counter of knock. It
+// rejects counters that do not exceed the last accepted one, which catches
+// replays that the in-memory nonce store forgets on restart.
+func (v *Verifier) counterValid(knock *spa.Knock) bool {
+	if knock.Counter == 0 {
+		return !v.requireCounter
+	}
+	advanced, err := v.db.AdvanceCounter(knock.AgentID, knock.Counter)
+	if err != nil {
+		log.Printf("[SPA] Failed to update counter for agent %d: %v", knock.AgentID, err)
+		return false
+	}
+	if !advanced {
+		log.Printf("[SPA] Rejected knock from agent %d: counter %d replayed or out of order", knock.AgentID, knock.Counter)
+	}
+	return advanced
+}
+
+// otpValid checks the second factor of knock, which opens ports. A TOTP
+// code is needed when ports include a port of a service in otp_services,
+// however the knock asked for it, or for any knock with require_otp. Close
+// knocks never need one. Wrong codes in a row lock the agent out for a
+// growing time, see otpLockedUntil. Signed knocks are not encrypted, so a
+// code in one is only accepted when the knock was sealed.
+func (v *Verifier) otpValid(knock *spa.Knock, sealed bool, ports []int, now time.Time) bool {
+	if knock.OTP != "" && knock.Mode == spa.ModeSigned && !sealed {
+		log.Printf("[SPA] Rejected knock from agent %d: OTP code sent in an unsealed signed knock", knock.AgentID)
+		return false
+	}
+	required := v.requireOTP || slices.ContainsFunc(ports, func(port int) bool {
+		return slices.Contains(v.otpPorts, port)
+	})
+	if knock.Close || (!required && knock.OTP == "") {
+		return true
+	}
+
+	secret, err := v.db.TOTPSecret(knock.AgentID)
+	if err != nil {
+		log.Printf("[SPA] Failed to load TOTP secret for agent %d: %v", knock.AgentID, err)
+		return false
+	}
+	switch {
+	case secret == nil && required:
+		log.Printf("[SPA] Rejected knock from agent %d: OTP required but no TOTP secret enrolled", knock.AgentID)
+		return false
+	case secret == nil:
+		return true
+	}
+
+	failures, last, err := v.db.OTPFailures(knock.AgentID)
+	if err != nil {
+		log.Printf("[SPA] Failed to load OTP failures for agent %d: %v", knock.AgentID, err)
+		return false
+	}
+	if until := otpLockedUntil(failures, last); now.Before(until) {
+		log.Printf("[SPA] Rejected knock from agent %d: OTP locked until %s after %d wrong codes", knock.AgentID, until.Format(time.RFC3339), failures)
+		return false
+	}
+	if !checkTOTP(secret, knock.OTP, now) {
+		if err := v.db.RecordOTPFailure(knock.AgentID, now); err != nil {
+			log.Printf("[SPA] Failed to record OTP failure for agent %d: %v", knock.AgentID, err)
+		}
+		log.Printf("[SPA] Rejected knock from agent %d: invalid OTP code (%d in a row)", knock.AgentID, failures+1)
+		return false
+	}
+	if failures > 0 {
+		if err := v.db.ResetOTPFailures(knock.AgentID); err != nil {
+			log.Printf("[SPA] Failed to reset OTP failures for agent %d: %v", knock.AgentID, err)
+		}
+	}
+	return true
+}
+
+// isLocalAddr reports whether addr is one of the configured server
+// addresses or is assigned to a local interface.
+func (v *Verifier) isLocalAddr(addr net.IP) bool {
+	for _, a := range v.serverAddrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("[SPA] Failed to list interface addresses: %v", err)
+		return false
+	}
+	for _, a := range ifaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// keysFor picks the keys to try decoding packet with from its clear-text
+// header, and the agent name for signed knocks.
+func (v *Verifier) keysFor(packet []byte, now time.Time) ([]spa.Keys, string) {
+	h, err := spa.PeekHeader(packet)
+	if err != nil {
+		// Not a v3 knock, so it can only be a legacy v2 one.
+		if v.requireAgentKeys {
+			return nil, ""
+		}
+		return sharedKeys(v.masterKeys(0, now)), ""
+	}
+
+	switch h.Mode {
+	case spa.ModeShared:
+		if v.requireAgentKeys {
+			return nil, ""
+		}
+		return sharedKeys(v.masterKeys(h.KeyID, now)), ""
+	case spa.ModeAgent:
+		var candidates []spa.Keys
+		for _, k := range v.masterKeys(h.KeyID, now) {
+			agentKey, err := spa.DeriveAgentKey(k.master, h.AgentID)
+			if err != nil {
+				continue
+			}
+			if keys, err := spa.DeriveKeys(agentKey); err == nil {
+				candidates = append(candidates, keys)
+			}
+		}
+		return candidates, ""
+	case spa.ModeSigned:
+		ak, ok := v.authorizedKeys[h.AgentID]
+		if !ok {
+			return nil, ""
+		}
+		return []spa.Keys{{VerifyKey: ak.Key}}, ak.Name
+	default:
+		return nil, ""
+	}
+}
+
+// masterKeys returns the master keys valid at now that a knock with the
+// given key ID hint may be sealed with: only the hinted key, or every valid
+// key for knocks without a hint.
+func (v *Verifier) masterKeys(keyID uint32, now time.Time) []*ringKey {
+	var keys []*ringKey
+	for _, k := range v.ring {
+		if !k.validAt(now) {
+			continue
+		}
+		if keyID == 0 {
+			keys = append(keys, k)
+		} else if k.id == keyID {
+			return []*ringKey{k}
+		}
+	}
+	if keyID != 0 {
+		return nil
+	}
+	return keys
+}
+
+func sharedKeys(ring []*ringKey) []spa.Keys {
+	keys := make([]spa.Keys, len(ring))
+	for i, k := range ring {
+		keys[i] = k.keys
+	}
+	return keys
+}
+
+func (v *Verifier) versionAllowed(version byte, now time.Time) bool {
+	switch version {
+	case spa.Version3:
+		return true
+	case spa.Version2:
+		return v.acceptV2 && (v.acceptV2Until.IsZero() || now.Before(v.acceptV2Until))
+	default:
+		return false
+	}
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"slices"
+	"testing"
+
+	"knockknock/spa"
+)
+
+func TestPortsFor(t *testing.T) {
+	v := &Verifier{
+		allowPorts: []int{22, 3389, 8080},
+		services:   map[string][]int{"ssh": {22}, "rdp": {3389}, "web": {80, 443}},
+		agentServices: map[string][]string{
+			"1":      {"ssh", "rdp"},
+			"laptop": {"ssh"},
+			"none":   {},
+		},
+	}
+	tests := []struct {
+		name     string
+		agentID  uint64
+		keyName  string
+		services []string
+		ports    []int
+		ok       bool
+	}{
+		{"unlimited agent, no services", 2, "", nil, []int{22, 3389, 8080}, true},
+		{"unlimited agent, services", 2, "", []string{"ssh"}, nil, false},
+		{"limited agent, no services", 1, "", nil, []int{22, 3389}, true},
+		{"limited agent, allowed services", 1, "", []string{"rdp"}, []int{3389}, true},
+		{"limited agent, other service", 1, "", []string{"web"}, nil, false},
+		{"limited by name, no services", 3, "laptop", nil, []int{22}, true},
+		{"limited by name, other service", 3, "laptop", []string{"rdp"}, nil, false},
+		{"no allowed services", 4, "none", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports, ok := v.portsFor(&spa.Knock{AgentID: tt.agentID, Services: tt.services}, tt.keyName)
+			if ok != tt.ok || !slices.Equal(ports, tt.ports) {
+				t.Errorf("portsFor = %v, %v, want %v, %v", ports, ok, tt.ports, tt.ok)
+			}
+		})
+	}
+
+	// A "*" entry limits every agent without an entry of its own
+	v.agentServices["*"] = []string{"web"}
+	if ports, ok := v.portsFor(&spa.Knock{AgentID: 2}, ""); !ok || !slices.Equal(ports, []int{80, 443}) {
+		t.Errorf("portsFor with a \"*\" entry = %v, %v, want [80 443], true", ports, ok)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	db, err := NewDB(t.TempDir() + "/knockd.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	master := bytes.Repeat([]byte{0x42}, spa.KeySize)
+	keys, err := spa.DeriveKeys(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ServerID: "gw1", AllowPorts: []int{22}}
+	v, err := NewVerifier(cfg, master, NewNonceStore(validTimeWindow), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		replayed = 1001 // agent whose counter has reached 100
+		revoked  = 1002
+	)
+	if _, err := db.AdvanceCounter(replayed, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	client := net.ParseIP("198.51.100.7").To4()
+	other := net.ParseIP("198.51.100.8").To4()
+	tests := []struct {
+		name     string
+		binding  string
+		acceptV2 bool
+		src      net.IP
+		knock    func(k *spa.Knock)
+		ok       bool
+	}{
+		{"bound to this server", sourceBindingPermissive, false, client, func(k *spa.Knock) {}, true},
+		{"bound to another server ID", sourceBindingPermissive, false, client, func(k *spa.Knock) { k.ServerID = "gw2" }, false},
+		{"bound to another server address", sourceBindingPermissive, false, client, func(k *spa.Knock) { k.ServerID, k.ServerAddr = "", net.ParseIP("192.0.2.99").To4() }, false},
+		{"source mismatch, permissive", sourceBindingPermissive, false, other, func(k *spa.Knock) {}, false},
+		{"source mismatch, strict", sourceBindingStrict, false, other, func(k *spa.Knock) {}, false},
+		{"source mismatch, off", sourceBindingOff, false, other, func(k *spa.Knock) {}, true},
+		{"any source, permissive", sourceBindingPermissive, false, other, func(k *spa.Knock) { k.ClientAddr, k.AnySource = nil, true }, true},
+		{"any source, strict", sourceBindingStrict, false, other, func(k *spa.Knock) { k.ClientAddr, k.AnySource = nil, true }, false},
+		{"relayed with a client address", sourceBindingStrict, false, nil, func(k *spa.Knock) {}, true},
+		{"replayed counter", sourceBindingPermissive, false, client, func(k *spa.Knock) { k.AgentID, k.Counter = replayed, 100 }, false},
+		{"advanced counter", sourceBindingPermissive, false, client, func(k *spa.Knock) { k.AgentID, k.Counter = replayed, 101 }, true},
+		{"revoked agent", sourceBindingPermissive, false, client, func(k *spa.Knock) { k.AgentID = revoked }, false},
+		{"v2, accept_v2 off", sourceBindingOff, false, client, func(k *spa.Knock) { k.Version = spa.Version2 }, false},
+		{"v2, accept_v2 on", sourceBindingOff, true, client, func(k *spa.Knock) { k.Version = spa.Version2 }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v.sourceBinding, v.acceptV2 = tt.binding, tt.acceptV2
+			k, err := spa.NewKnock(7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k.Version, k.Suite = spa.Version3, spa.SuiteAES256GCM
+			k.ServerID, k.ClientAddr = "gw1", client
+			tt.knock(k)
+			if k.Version == spa.Version2 {
+				k.Suite, k.ServerID, k.ClientAddr = spa.SuiteNone, "", nil
+			}
+			packet, err := spa.Encode(keys, k, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, ok := v.Verify(packet, tt.src)
+			if ok != tt.ok {
+				t.Fatalf("Verify = %v, want %v", ok, tt.ok)
+			}
+			if ok && (info.AgentID != k.AgentID || !slices.Equal(info.Ports, []int{22})) {
+				t.Errorf("Verify = %+v, want agent %d, ports [22]", info, k.AgentID)
+			}
+		})
+	}
+}
+
+func TestGrantAddr(t *testing.T) {
+	tests := []struct {
+		prefixLen int
+		ip        string
+		want      string
+	}{
+		{0, "198.51.100.7", "198.51.100.7"},
+		{0, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2:3:4:5:6"},
+		{64, "198.51.100.7", "198.51.100.7"},
+		{64, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{56, "2001:db8:1:2ff:3:4:5:6", "2001:db8:1:200::/56"},
+		{128, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2:3:4:5:6/128"},
+	}
+	for _, tt := range tests {
+		v := &Verifier{ipv6PrefixLen: tt.prefixLen}
+		if got := v.grantAddr(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("grantAddr(%s) with prefix length %d = %s, want %s", tt.ip, tt.prefixLen, got, tt.want)
+		}
+	}
+}
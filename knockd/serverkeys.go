@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"knockknock/spa"
+)
+
+// ServerKeyConfig is a private key in server_keys that sealed knocks are
+// encrypted to. The validity window is the key's epoch: knockd accepts
+// knocks sealed to it only within the window and erases it once the
+// window ends, so a later leak of the server opens no earlier knocks.
+// A plain string is a key without a window, kept until removed by hand.
+type ServerKeyConfig struct {
+	Key       string    `toml:"key"`
+	NotBefore time.Time `toml:"not_before"`
+	NotAfter  time.Time `toml:"not_after"`
+}
+
+// UnmarshalTOML accepts a [[server_keys]] table or a plain base64 string.
+func (kc *ServerKeyConfig) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		kc.Key = v
+		return nil
+	case map[string]any:
+		for name, value := range v {
+			var ok bool
+			switch name {
+			case "key":
+				kc.Key, ok = value.(string)
+			case "not_before":
+				kc.NotBefore, ok = value.(time.Time)
+			case "not_after":
+				kc.NotAfter, ok = value.(time.Time)
+			default:
+				return fmt.Errorf("unknown server_keys field %q", name)
+			}
+			if !ok {
+				return fmt.Errorf("invalid server_keys %s: %v", name, value)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("server_keys entries must be strings or tables, got %T", v)
+	}
+}
+
+// expiredAt reports whether the epoch of the key has ended at now.
+func (kc *ServerKeyConfig) expiredAt(now time.Time) bool {
+	return !kc.NotAfter.IsZero() && !now.Before(kc.NotAfter)
+}
+
+// serverKey is a decoded server key: an X25519 or a hybrid private key.
+type serverKey struct {
+	x25519    *ecdh.PrivateKey
+	hybrid    *spa.HybridPrivateKey
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// validAt reports whether knocks sealed to the key are accepted at now.
+func (k *serverKey) validAt(now time.Time) bool {
+	return (k.notBefore.IsZero() || !now.Before(k.notBefore)) &&
+		(k.notAfter.IsZero() || now.Before(k.notAfter))
+}
+
+// loadServerKeys decodes the server keys of cfg whose epoch has not ended
+// at now, keyed by the ServerKeyID of their public key.
+func loadServerKeys(cfg *Config, now time.Time) (map[uint64]*serverKey, error) {
+	keys := make(map[uint64]*serverKey)
+	for _, kc := range cfg.ServerKeys {
+		if kc.expiredAt(now) {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(kc.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode server key: %w", err)
+		}
+		sk := &serverKey{notBefore: kc.NotBefore, notAfter: kc.NotAfter}
+		var pub []byte
+		if len(raw) == spa.HybridPrivateKeySize {
+			if sk.hybrid, err = spa.ParseHybridPrivateKey(raw); err != nil {
+				return nil, fmt.Errorf("invalid hybrid server key: %w", err)
+			}
+			pub = sk.hybrid.PublicKey().Bytes()
+		} else {
+			if sk.x25519, err = ecdh.X25519().NewPrivateKey(raw); err != nil {
+				return nil, fmt.Errorf("invalid server key: %w", err)
+			}
+			pub = sk.x25519.PublicKey().Bytes()
+		}
+		keys[spa.KeyID(pub)] = sk
+	}
+	return keys, nil
+}
+
+// eraseExpiredServerKeys removes the [[server_keys]] entries of cfg whose
+// epoch has ended at now from the configuration file at path, keeping its
+// comments and layout. It returns the number of entries removed.
+func eraseExpiredServerKeys(cfg *Config, path string, now time.Time) (int, error) {
+	var expired int
+	for _, kc := range cfg.ServerKeys {
+		if kc.expiredAt(now) {
+			expired++
+		}
+	}
+	if expired == 0 {
+		return 0, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// Drop the header and the fields of each expired entry. Comments and
+	// blank lines stay, as they may belong to the next table.
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	var out []string
+	entry, dropping := -1, false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "[[server_keys]]":
+			entry++
+			dropping = entry < len(cfg.ServerKeys) && cfg.ServerKeys[entry].expiredAt(now)
+		case strings.HasPrefix(trimmed, "["):
+			dropping = false
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			out = append(out, line)
+			continue
+		}
+		if !dropping {
+			out = append(out, line)
+		}
+	}
+	if entry < 0 {
+		return 0, fmt.Errorf("expired server keys are not [[server_keys]] tables")
+	}
+
+	remaining := cfg.ServerKeys[:0]
+	for _, kc := range cfg.ServerKeys {
+		if !kc.expiredAt(now) {
+			remaining = append(remaining, kc)
+		}
+	}
+	cfg.ServerKeys = remaining
+	return expired, replaceFile(path, []byte(strings.Join(out, "\n")+"\n"), info.Mode().Perm())
+}
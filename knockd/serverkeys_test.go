@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"knockknock/spa"
+)
+
+func TestServerKeyConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knockd.toml")
+	if err := os.WriteFile(path, []byte(`server_keys = ["a2V5"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.ServerKeys) != 1 || cfg.ServerKeys[0] != (ServerKeyConfig{Key: "a2V5"}) {
+		t.Errorf("plain server key = %+v, want a key without an epoch", cfg.ServerKeys)
+	}
+
+	if err := os.WriteFile(path, []byte("[[server_keys]]\nkey = \"a2V5\"\nnot_before = 2026-10-01T00:00:00Z\nnot_after = 2026-11-01T00:00:00Z\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	want := ServerKeyConfig{Key: "a2V5", NotBefore: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), NotAfter: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)}
+	if len(cfg.ServerKeys) != 1 || !cfg.ServerKeys[0].NotAfter.Equal(want.NotAfter) || !cfg.ServerKeys[0].NotBefore.Equal(want.NotBefore) || cfg.ServerKeys[0].Key != want.Key {
+		t.Errorf("server key table = %+v, want %+v", cfg.ServerKeys, want)
+	}
+
+	if err := os.WriteFile(path, []byte("[[server_keys]]\nkey = \"a2V5\"\nnot_afer = 2026-11-01T00:00:00Z\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("misspelled server_keys field accepted")
+	}
+}
+
+const epochConfig = `# knockd configuration
+key = "QEFCQ0RFRkdISUpLTE1OT1BRUlNUVVZXWFlaW1xdXl8="
+
+# September
+[[server_keys]]
+key        = "%s"
+not_before = 2026-09-01T00:00:00Z
+not_after  = 2026-10-01T00:00:00Z
+
+# October
+[[server_keys]]
+key        = "%s"
+not_before = 2026-10-01T00:00:00Z
+not_after  = 2026-11-01T00:00:00Z
+
+[services]
+ssh = [22]
+`
+
+func TestServerKeyEpochs(t *testing.T) {
+	var priv [2]*ecdh.PrivateKey
+	var encoded [2]any
+	for i := range priv {
+		var err error
+		if priv[i], err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+		encoded[i] = base64.StdEncoding.EncodeToString(priv[i].Bytes())
+	}
+	path := filepath.Join(t.TempDir(), "knockd.toml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(epochConfig, encoded[:]...)), 0640); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	september := time.Date(2026, 9, 15, 0, 0, 0, 0, time.UTC)
+	october := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+
+	keys, err := loadServerKeys(cfg, september)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{serverKeys: keys}
+	inner := append([]byte{spa.Version3}, "inner knock"...)
+	seal := func(i int) []byte {
+		packet, err := spa.Seal(priv[i].PublicKey(), spa.SuiteAES256GCM, inner, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packet
+	}
+
+	// Each key only opens knocks within its epoch
+	tests := []struct {
+		name string
+		key  int
+		now  time.Time
+		ok   bool
+	}{
+		{"September key in September", 0, september, true},
+		{"October key in September", 1, september, false},
+		{"September key in October", 0, october, false},
+		{"October key in October", 1, october, true},
+	}
+	for _, tt := range tests {
+		got, sealed, ok := v.unseal(seal(tt.key), tt.now)
+		if ok != tt.ok || ok && (!sealed || !bytes.Equal(got, inner)) {
+			t.Errorf("%s: unseal = %q, %v, %v, want ok %v", tt.name, got, sealed, ok, tt.ok)
+		}
+	}
+
+	// Once its epoch ends, the key is dropped from memory and the file
+	v.expireServerKeys(october)
+	if len(v.serverKeys) != 1 {
+		t.Errorf("%d server keys left in October, want 1", len(v.serverKeys))
+	}
+	n, err := eraseExpiredServerKeys(cfg, path, october)
+	if err != nil || n != 1 {
+		t.Fatalf("eraseExpiredServerKeys = %d, %v, want 1", n, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), encoded[0].(string)) || !strings.Contains(string(data), encoded[1].(string)) {
+		t.Errorf("erased file does not hold exactly the October key:\n%s", data)
+	}
+	for _, line := range []string{"# September", "# October", "[services]", "ssh = [22]"} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("erased file lost line %q:\n%s", line, data)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("erased file mode = %v, want 0640", info.Mode().Perm())
+	}
+	erased, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("erased file does not parse: %v\n%s", err, data)
+	}
+	if len(erased.ServerKeys) != 1 || len(cfg.ServerKeys) != 1 {
+		t.Errorf("%d server keys in the file and %d in the config after erasing, want 1", len(erased.ServerKeys), len(cfg.ServerKeys))
+	}
+	if n, err := eraseExpiredServerKeys(cfg, path, october); err != nil || n != 0 {
+		t.Errorf("second eraseExpiredServerKeys = %d, %v, want 0", n, err)
+	}
+}
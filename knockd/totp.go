@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults understood by authenticator apps).
+const (
+	totpSecretSize = 20
+	totpStep       = 30 * time.Second
+	totpDigits     = 6
+	totpSkew       = 1 // steps accepted on either side of the current one
+)
+
+// Wrong codes in a row lock an agent out of OTP checks for otpBackoff,
+// doubling with every further wrong code up to otpMaxBackoff, so that a
+// stolen device cannot guess its way through the code space.
+const (
+	otpFreeFailures = 3
+	otpBackoff      = 30 * time.Second
+	otpMaxBackoff   = 24 * time.Hour
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret generates a random TOTP secret.
+func newTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// totpURI returns the otpauth URI to import secret into an authenticator app.
+func totpURI(secret []byte, agentID uint64) string {
+	v := url.Values{}
+	v.Set("secret", totpEncoding.EncodeToString(secret))
+	v.Set("issuer", "knockknock")
+	return fmt.Sprintf("otpauth://totp/knockknock:%d?%s", agentID, v.Encode())
+}
+
+// totpCode computes the code of secret for the time step containing t.
+func totpCode(secret []byte, t time.Time) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(t.Unix()/int64(totpStep/time.Second))))
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// checkTOTP reports whether code is valid for secret at now, allowing for
+// totpSkew steps of clock drift.
+func checkTOTP(secret []byte, code string, now time.Time) bool {
+	valid := false
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected := totpCode(secret, now.Add(time.Duration(i)*totpStep))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// otpLockedUntil returns the time until which an agent with failures wrong
+// codes in a row, the last one at last, may not try another code.
+func otpLockedUntil(failures int, last time.Time) time.Time {
+	if failures < otpFreeFailures {
+		return time.Time{}
+	}
+	backoff := otpBackoff
+	for i := otpFreeFailures; i < failures && backoff < otpMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return last.Add(min(backoff, otpMaxBackoff))
+}
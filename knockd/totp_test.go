@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"knockknock/spa"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B, SHA-1, truncated to six digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, time.Unix(tt.unix, 0)); got != tt.code {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"current step", "050471", true},
+		{"previous step", totpCode(rfc6238Secret, now.Add(-totpStep)), true},
+		{"next step", totpCode(rfc6238Secret, now.Add(totpStep)), true},
+		{"two steps ago", totpCode(rfc6238Secret, now.Add(-2*totpStep)), false},
+		{"two steps ahead", totpCode(rfc6238Secret, now.Add(2*totpStep)), false},
+		{"wrong code", "000000", false},
+		{"empty", "", false},
+		{"eight digits", "14050471", false},
+	}
+	for _, tt := range tests {
+		if got := checkTOTP(rfc6238Secret, tt.code, now); got != tt.want {
+			t.Errorf("%s: checkTOTP(%q) = %v, want %v", tt.name, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestOTPLockedUntil(t *testing.T) {
+	last := time.Unix(1700000000, 0)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{otpFreeFailures - 1, 0},
+		{otpFreeFailures, otpBackoff},
+		{otpFreeFailures + 1, 2 * otpBackoff},
+		{otpFreeFailures + 3, 8 * otpBackoff},
+		{otpFreeFailures + 100, otpMaxBackoff},
+	}
+	for _, tt := range tests {
+		until := otpLockedUntil(tt.failures, last)
+		if tt.want == 0 && !until.IsZero() || tt.want != 0 && !until.Equal(last.Add(tt.want)) {
+			t.Errorf("otpLockedUntil(%d) = %s, want %s after the last failure", tt.failures, until, tt.want)
+		}
+	}
+}
+
+func TestOTPValid(t *testing.T) {
+	db, err := NewDB(t.TempDir() + "/knockd.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const agentID = 42
+	if err := db.SetTOTPSecret(agentID, rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{db: db, otpPorts: []int{3389}}
+	now := time.Unix(1111111111, 0)
+
+	// Port 3389 needs a code however the knock asked for it
+	knock := &spa.Knock{AgentID: agentID}
+	if v.otpValid(knock, false, []int{22, 3389}, now) {
+		t.Error("knock opening an OTP port without a code was accepted")
+	}
+	if !v.otpValid(knock, false, []int{22}, now) {
+		t.Error("knock opening no OTP port was rejected")
+	}
+	knock.OTP = "050471"
+	if !v.otpValid(knock, false, []int{22, 3389}, now) {
+		t.Error("knock with a valid code was rejected")
+	}
+
+	// Wrong codes lock the agent out, even for the right code
+	wrong := &spa.Knock{AgentID: agentID, OTP: "000000"}
+	for range otpFreeFailures {
+		if v.otpValid(wrong, false, []int{3389}, now) {
+			t.Fatal("knock with a wrong code was accepted")
+		}
+	}
+	if v.otpValid(knock, false, []int{3389}, now) {
+		t.Error("valid code accepted during the lockout")
+	}
+	if failures, _, _ := db.OTPFailures(agentID); failures != otpFreeFailures {
+		t.Errorf("%d failures recorded, want %d", failures, otpFreeFailures)
+	}
+
+	// After the lockout a valid code is accepted and resets the failures
+	later := now.Add(otpBackoff)
+	knock.OTP = totpCode(rfc6238Secret, later)
+	if !v.otpValid(knock, false, []int{3389}, later) {
+		t.Error("valid code rejected after the lockout")
+	}
+	if failures, _, _ := db.OTPFailures(agentID); failures != 0 {
+		t.Errorf("%d failures left after a valid code, want 0", failures)
+	}
+
+	// Signed knocks carry the code in clear unless sealed
+	signed := &spa.Knock{AgentID: agentID, Mode: spa.ModeSigned, OTP: totpCode(rfc6238Secret, later)}
+	if v.otpValid(signed, false, []int{3389}, later) {
+		t.Error("code in an unsealed signed knock was accepted")
+	}
+	if !v.otpValid(signed, true, []int{3389}, later) {
+		t.Error("code in a sealed signed knock was rejected")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"knockknock/spa"
+)
+
+// Knock transports.
+const (
+	transportTCP  = "tcp"  // knock spread over a TCP SYN
+	transportUDP  = "udp"  // knock in a UDP datagram
+	transportICMP = "icmp" // knock in an ICMP echo request
+	transportDNS  = "dns"  // knock in a query name, relayed by resolvers
+)
+
+// Transports extracts knocks from sniffed packets for the enabled
+// transports. Nothing listens on the knock ports; the datagrams are only
+// seen by the sniffer.
+type Transports struct {
+	tcp       bool
+	udp       bool
+	icmp      bool
+	dns       bool
+	udpPorts  []uint16
+	dnsDomain string
+}
+
+// NewTransports enables the transports listed in cfg, TCP only by default.
+// Without a udp_port, UDP knocks are accepted on the ports derived from
+// every master key of the key ring.
+func NewTransports(cfg *Config, ring []*ringKey) (*Transports, error) {
+	names := cfg.Transports
+	if len(names) == 0 {
+		names = []string{transportTCP}
+	}
+
+	t := &Transports{}
+	for _, name := range names {
+		switch name {
+		case transportTCP:
+			t.tcp = true
+		case transportUDP:
+			t.udp = true
+		case transportICMP:
+			t.icmp = true
+		case transportDNS:
+			if cfg.DNSDomain == "" {
+				return nil, fmt.Errorf("the dns transport needs dns_domain")
+			}
+			t.dns, t.dnsDomain = true, cfg.DNSDomain
+		default:
+			return nil, fmt.Errorf("unknown transport: %s", name)
+		}
+	}
+
+	if !t.udp {
+		return t, nil
+	}
+	switch {
+	case cfg.UDPPort < 0 || cfg.UDPPort > 65535:
+		return nil, fmt.Errorf("invalid udp_port: %d", cfg.UDPPort)
+	case cfg.UDPPort != 0:
+		t.udpPorts = []uint16{uint16(cfg.UDPPort)}
+	default:
+		for _, k := range ring {
+			port, err := spa.KnockPort(k.master)
+			if err != nil {
+				return nil, err
+			}
+			t.udpPorts = append(t.udpPorts, port)
+		}
+		if len(t.udpPorts) == 0 {
+			return nil, fmt.Errorf("the udp transport needs udp_port or a master key")
+		}
+	}
+	return t, nil
+}
+
+// Knock returns the encoded knock carried by pkt and its source address.
+// The address is nil for DNS knocks, whose packet source is a resolver.
+func (t *Transports) Knock(pkt gopacket.Packet) ([]byte, net.IP, bool) {
+	// IPv6 SYN knocks carry the bytes of the IPv4 ID in the SYN data, so
+	// ip stays nil for them.
+	var ip *layers.IPv4
+	var src net.IP
+	switch network := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		ip, src = network, network.SrcIP
+	case *layers.IPv6:
+		src = network.SrcIP
+	default:
+		return nil, nil, false
+	}
+
+	if echo, ok := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		if !t.icmp || echo.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+			return nil, nil, false
+		}
+		packet, err := spa.DecodeUDP(echo.Payload)
+		return packet, src, err == nil
+	}
+	if echo, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		// The payload starts with the echo identifier and sequence number
+		if !t.icmp || echo.TypeCode.Type() != layers.ICMPv6TypeEchoRequest || len(echo.Payload) < 4 {
+			return nil, nil, false
+		}
+		packet, err := spa.DecodeUDP(echo.Payload[4:])
+		return packet, src, err == nil
+	}
+
+	if query, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS); ok && t.dns && !query.QR {
+		for _, q := range query.Questions {
+			if packet, err := spa.DecodeDNS(string(q.Name), t.dnsDomain); err == nil {
+				return packet, nil, true
+			}
+		}
+	}
+
+	switch transport := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		if !t.tcp {
+			return nil, nil, false
+		}
+		packet, err := spa.DecodeSYN(ip, transport)
+		return packet, src, err == nil
+	case *layers.UDP:
+		if !t.udp || !slices.Contains(t.udpPorts, uint16(transport.DstPort)) {
+			return nil, nil, false
+		}
+		packet, err := spa.DecodeUDP(transport.Payload)
+		return packet, src, err == nil
+	default:
+		return nil, nil, false
+	}
+}
+
+// String lists the enabled transports for the startup log.
+func (t *Transports) String() string {
+	var names []string
+	if t.tcp {
+		names = append(names, transportTCP)
+	}
+	if t.udp {
+		names = append(names, fmt.Sprintf("%s (ports %v)", transportUDP, t.udpPorts))
+	}
+	if t.icmp {
+		names = append(names, transportICMP)
+	}
+	if t.dns {
+		names = append(names, fmt.Sprintf("%s (%s)", transportDNS, t.dnsDomain))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"knockknock/spa"
+)
+
+// testKnock returns an encoded v3 knock.
+func testKnock(t *testing.T) []byte {
+	t.Helper()
+	keys, err := spa.DeriveKeys(bytes.Repeat([]byte{0x42}, spa.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := spa.NewKnock(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Suite = spa.SuiteAES256GCM
+	packet, err := spa.Encode(keys, k, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// serialize builds a packet from ls as the sniffer would see it.
+func serialize(t *testing.T, first gopacket.LayerType, ls ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), first, gopacket.Default)
+}
+
+func TestTransportsKnock(t *testing.T) {
+	const domain = "knock.example.com"
+	tr, err := NewTransports(&Config{Transports: []string{"tcp", "udp", "icmp", "dns"}, UDPPort: 40000, DNSDomain: domain}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knock := testKnock(t)
+	client4 := net.ParseIP("198.51.100.7").To4()
+	server4 := net.ParseIP("203.0.113.10").To4()
+	client6 := net.ParseIP("2001:db8::7")
+	server6 := net.ParseIP("2001:db8::1")
+	ip4 := func(proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: client4, DstIP: server4}
+	}
+	ip6 := func(next layers.IPProtocol) *layers.IPv6 {
+		return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: next, SrcIP: client6, DstIP: server6}
+	}
+
+	syn4 := func() gopacket.Packet {
+		ip, tcp := ip4(layers.IPProtocolTCP), &layers.TCP{SrcPort: 40001, DstPort: 80}
+		tcp.SetNetworkLayerForChecksum(ip)
+		data, err := spa.EncodeSYN(knock, ip, tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serialize(t, layers.LayerTypeIPv4, ip, tcp, gopacket.Payload(data))
+	}
+	// IPv6 has no IP ID, so its bytes travel in the SYN data
+	syn6 := func() gopacket.Packet {
+		ip, tcp := ip6(layers.IPProtocolTCP), &layers.TCP{SrcPort: 40001, DstPort: 80}
+		tcp.SetNetworkLayerForChecksum(ip)
+		data, err := spa.EncodeSYN(knock, nil, tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serialize(t, layers.LayerTypeIPv6, ip, tcp, gopacket.Payload(data))
+	}
+	udp := func(port layers.UDPPort) gopacket.Packet {
+		ip, udp := ip4(layers.IPProtocolUDP), &layers.UDP{SrcPort: 40001, DstPort: port}
+		udp.SetNetworkLayerForChecksum(ip)
+		return serialize(t, layers.LayerTypeIPv4, ip, udp, gopacket.Payload(spa.EncodeUDP(knock)))
+	}
+	ping4 := func(typ uint8) gopacket.Packet {
+		echo := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(typ, 0), Id: 0x1234, Seq: 1}
+		return serialize(t, layers.LayerTypeIPv4, ip4(layers.IPProtocolICMPv4), echo, gopacket.Payload(spa.EncodeUDP(knock)))
+	}
+	// The ICMPv6 layer leaves the echo identifier and sequence number in
+	// its payload, ahead of the knock
+	ping6 := func() gopacket.Packet {
+		ip := ip6(layers.IPProtocolICMPv6)
+		echo := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+		echo.SetNetworkLayerForChecksum(ip)
+		return serialize(t, layers.LayerTypeIPv6, ip, echo, &layers.ICMPv6Echo{Identifier: 0x1234, SeqNumber: 1}, gopacket.Payload(spa.EncodeUDP(knock)))
+	}
+	dns := func(response bool) gopacket.Packet {
+		name, err := spa.EncodeDNS(knock, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, udp := ip4(layers.IPProtocolUDP), &layers.UDP{SrcPort: 40001, DstPort: 53}
+		udp.SetNetworkLayerForChecksum(ip)
+		query := &layers.DNS{ID: 1, QR: response, RD: true, Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+		return serialize(t, layers.LayerTypeIPv4, ip, udp, query)
+	}
+
+	tests := []struct {
+		name string
+		pkt  gopacket.Packet
+		src  net.IP // nil for relayed knocks
+		ok   bool
+	}{
+		{"IPv4 SYN", syn4(), client4, true},
+		{"IPv6 SYN", syn6(), client6, true},
+		{"UDP on the knock port", udp(40000), client4, true},
+		{"UDP on another port", udp(40002), nil, false},
+		{"ICMP echo request", ping4(layers.ICMPv4TypeEchoRequest), client4, true},
+		{"ICMP echo reply", ping4(layers.ICMPv4TypeEchoReply), nil, false},
+		{"ICMPv6 echo request", ping6(), client6, true},
+		{"DNS query", dns(false), nil, true},
+		{"DNS response", dns(true), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.pkt.ErrorLayer(); err != nil {
+				t.Fatalf("decoding the test packet: %v", err.Error())
+			}
+			packet, src, ok := tr.Knock(tt.pkt)
+			if ok != tt.ok {
+				t.Fatalf("Knock ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if !bytes.Equal(packet, knock) {
+				t.Errorf("Knock = %x, want %x", packet, knock)
+			}
+			if !src.Equal(tt.src) {
+				t.Errorf("Knock source = %v, want %v", src, tt.src)
+			}
+		})
+	}
+
+	// Transports that are not enabled are ignored
+	tcpOnly, err := NewTransports(&Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range []gopacket.Packet{udp(40000), ping4(layers.ICMPv4TypeEchoRequest), ping6(), dns(false)} {
+		if _, _, ok := tcpOnly.Knock(pkt); ok {
+			t.Errorf("knock accepted over a disabled transport: %v", pkt)
+		}
+	}
+}
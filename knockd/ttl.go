@@ -3,6 +3,7 @@ package main
 
 import (
 	"math/bits"
+	"time"
 )
 
 // TTLEngine calculates the TTL for a given agent and IP.
@@ -26,3 +27,14 @@ func (e *TTLEngine) Next(agentID uint64, ip string) int {
 	}
 	return ttl
 }
+
+// Grant returns the TTL in minutes for a knock that requested the given
+// duration. The request is rounded up to whole minutes and clamped to the
+// TTL computed by Next; a zero request gets that TTL.
+func (e *TTLEngine) Grant(agentID uint64, ip string, requested time.Duration) int {
+	ttl := e.Next(agentID, ip)
+	if requested <= 0 {
+		return ttl
+	}
+	return min(ttl, int((requested+time.Minute-1)/time.Minute))
+}
@@ -0,0 +1,66 @@
+package spa
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// DNS name limits of RFC 1035, in presentation form without the final dot.
+const (
+	maxLabelLen = 63
+	maxNameLen  = 253
+)
+
+var (
+	// ErrNameTooLong is returned when a knock does not fit in a DNS name.
+	ErrNameTooLong = errors.New("spa: knock too long for a DNS name")
+	// ErrDomain is returned for an empty DNS domain.
+	ErrDomain = errors.New("spa: invalid DNS domain")
+)
+
+// dnsEncoding is case-insensitive once lowercased, so knocks survive
+// resolvers that randomise the case of query names.
+var dnsEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EncodeDNS returns the fully qualified query name carrying an encoded
+// knock under domain: the knock in lowercase base32, split into labels of
+// at most 63 characters. Only knocks of up to about 140 bytes, depending on
+// the length of domain, fit; sealed knocks do not.
+func EncodeDNS(packet []byte, domain string) (string, error) {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if domain == "" {
+		return "", ErrDomain
+	}
+
+	data := strings.ToLower(dnsEncoding.EncodeToString(packet))
+	var labels []string
+	for len(data) > maxLabelLen {
+		labels = append(labels, data[:maxLabelLen])
+		data = data[maxLabelLen:]
+	}
+	name := strings.Join(append(labels, data, domain), ".")
+	if len(name) > maxNameLen {
+		return "", ErrNameTooLong
+	}
+	return name + ".", nil
+}
+
+// DecodeDNS returns the knock carried by a query name built by EncodeDNS.
+func DecodeDNS(name, domain string) ([]byte, error) {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if domain == "" {
+		return nil, ErrDomain
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	data, ok := strings.CutSuffix(name, "."+domain)
+	if !ok || data == "" {
+		return nil, ErrNoKnock
+	}
+	packet, err := dnsEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(data, ".", "")))
+	if err != nil {
+		return nil, ErrNoKnock
+	}
+	return packet, nil
+}
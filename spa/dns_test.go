@@ -0,0 +1,47 @@
+package spa
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDNSVectors(t *testing.T) {
+	var vectors []struct {
+		Packet hexBytes `json:"packet"`
+		Domain string   `json:"domain"`
+		Name   string   `json:"name"`
+	}
+	loadVectors(t, "dns", &vectors)
+	for _, vec := range vectors {
+		name, err := EncodeDNS(vec.Packet, vec.Domain)
+		if err != nil || name != vec.Name {
+			t.Errorf("EncodeDNS = %q, %v, want %q", name, err, vec.Name)
+		}
+		packet, err := DecodeDNS(vec.Name, vec.Domain)
+		if err != nil || !bytes.Equal(packet, vec.Packet) {
+			t.Errorf("DecodeDNS(%q) = %x, %v", vec.Name, packet, err)
+		}
+
+		// Resolvers may randomise the case of the name
+		packet, err = DecodeDNS(strings.ToUpper(vec.Name), vec.Domain)
+		if err != nil || !bytes.Equal(packet, vec.Packet) {
+			t.Errorf("DecodeDNS of the upper-case name = %x, %v", packet, err)
+		}
+	}
+}
+
+func TestDNSErrors(t *testing.T) {
+	if _, err := EncodeDNS(make([]byte, 200), "knock.example.com"); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("EncodeDNS of 200 bytes = %v, want ErrNameTooLong", err)
+	}
+	if _, err := EncodeDNS([]byte{1}, "."); !errors.Is(err, ErrDomain) {
+		t.Errorf("EncodeDNS under the root = %v, want ErrDomain", err)
+	}
+	for _, name := range []string{"knock.example.com.", "aaaa.example.org.", "not-base32!.knock.example.com."} {
+		if _, err := DecodeDNS(name, "knock.example.com"); !errors.Is(err, ErrNoKnock) {
+			t.Errorf("DecodeDNS(%q) = %v, want ErrNoKnock", name, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package spa
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// HybridPublicKeySize is the size of an encoded hybrid public key:
+	// X25519(32) | ML-KEM-768 encapsulation key(1184).
+	HybridPublicKeySize = x25519KeySize + mlkem.EncapsulationKeySize768
+	// HybridPrivateKeySize is the size of an encoded hybrid private key:
+	// X25519(32) | ML-KEM-768 seed(64).
+	HybridPrivateKeySize = x25519KeySize + mlkem.SeedSize
+)
+
+// ErrHybridKey is returned for malformed hybrid keys.
+var ErrHybridKey = errors.New("spa: invalid hybrid key")
+
+// HybridPublicKey is a server public key for ModeHybrid envelopes.
+type HybridPublicKey struct {
+	X25519 *ecdh.PublicKey
+	MLKEM  *mlkem.EncapsulationKey768
+}
+
+// HybridPrivateKey is a server private key for ModeHybrid envelopes.
+type HybridPrivateKey struct {
+	X25519 *ecdh.PrivateKey
+	MLKEM  *mlkem.DecapsulationKey768
+}
+
+// GenerateHybridKey generates a new hybrid server key.
+func GenerateHybridKey() (*HybridPrivateKey, error) {
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return &HybridPrivateKey{X25519: x, MLKEM: m}, nil
+}
+
+// ParseHybridPrivateKey decodes a key encoded by HybridPrivateKey.Bytes.
+func ParseHybridPrivateKey(b []byte) (*HybridPrivateKey, error) {
+	if len(b) != HybridPrivateKeySize {
+		return nil, ErrHybridKey
+	}
+	x, err := ecdh.X25519().NewPrivateKey(b[:x25519KeySize])
+	if err != nil {
+		return nil, ErrHybridKey
+	}
+	m, err := mlkem.NewDecapsulationKey768(b[x25519KeySize:])
+	if err != nil {
+		return nil, ErrHybridKey
+	}
+	return &HybridPrivateKey{X25519: x, MLKEM: m}, nil
+}
+
+// ParseHybridPublicKey decodes a key encoded by HybridPublicKey.Bytes.
+func ParseHybridPublicKey(b []byte) (*HybridPublicKey, error) {
+	if len(b) != HybridPublicKeySize {
+		return nil, ErrHybridKey
+	}
+	x, err := ecdh.X25519().NewPublicKey(b[:x25519KeySize])
+	if err != nil {
+		return nil, ErrHybridKey
+	}
+	m, err := mlkem.NewEncapsulationKey768(b[x25519KeySize:])
+	if err != nil {
+		return nil, ErrHybridKey
+	}
+	return &HybridPublicKey{X25519: x, MLKEM: m}, nil
+}
+
+// Bytes encodes the private key.
+func (k *HybridPrivateKey) Bytes() []byte {
+	return append(k.X25519.Bytes(), k.MLKEM.Bytes()...)
+}
+
+// PublicKey returns the public half of the key.
+func (k *HybridPrivateKey) PublicKey() *HybridPublicKey {
+	return &HybridPublicKey{X25519: k.X25519.PublicKey(), MLKEM: k.MLKEM.EncapsulationKey()}
+}
+
+// Bytes encodes the public key.
+func (k *HybridPublicKey) Bytes() []byte {
+	return append(k.X25519.Bytes(), k.MLKEM.Bytes()...)
+}
+
+// SealHybrid wraps an encoded v3 knock in a ModeHybrid envelope. It works
+// like Seal, but the envelope key combines an X25519 exchange with an
+// ML-KEM-768 encapsulation, so the inner knock stays confidential unless
+// both are broken. The envelope is about 1.2 KB and travels as SYN data.
+//
+// Layout: Version(1) | Suite(1) | Mode(1)=4 | ServerKeyID(8) |
+// Ephemeral(32) | KEMCiphertext(1088) | IV(12) | CipherText | Tag(16).
+func SealHybrid(serverKey *HybridPublicKey, suite byte, inner []byte, random io.Reader) ([]byte, error) {
+	eph, xShared, err := x25519Exchange(serverKey.X25519, random)
+	if err != nil {
+		return nil, err
+	}
+	mShared, ct := serverKey.MLKEM.Encapsulate()
+
+	pub := serverKey.Bytes()
+	header := []byte{Version3, suite, ModeHybrid}
+	header = binary.BigEndian.AppendUint64(header, KeyID(pub))
+	header = append(header, eph...)
+	header = append(header, ct...)
+	return sealEnvelope(header, append(xShared, mShared...), pub, inner, random)
+}
+
+// UnsealHybrid opens a ModeHybrid envelope and returns the inner knock.
+func UnsealHybrid(serverKey *HybridPrivateKey, packet []byte) ([]byte, error) {
+	h, sealed, err := parseHeaderV3(packet)
+	if err != nil {
+		return nil, err
+	}
+	if h.Mode != ModeHybrid {
+		return nil, ErrMode
+	}
+	pub := serverKey.PublicKey().Bytes()
+	if h.ServerKeyID != KeyID(pub) {
+		return nil, ErrBadMAC
+	}
+
+	xShared, err := x25519Shared(serverKey.X25519, h.ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	mShared, err := serverKey.MLKEM.Decapsulate(h.kemCiphertext)
+	if err != nil {
+		return nil, ErrBadMAC
+	}
+	return openEnvelope(h, append(xShared, mShared...), pub, sealed)
+}
@@ -0,0 +1,51 @@
+package spa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestHybridVectors(t *testing.T) {
+	var vectors []struct {
+		ServerPrivateKey hexBytes `json:"server_private_key"`
+		Packet           hexBytes `json:"packet"`
+		Inner            hexBytes `json:"inner"`
+	}
+	loadVectors(t, "v3_hybrid", &vectors)
+	for _, vec := range vectors {
+		priv, err := ParseHybridPrivateKey(vec.ServerPrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inner, err := UnsealHybrid(priv, vec.Packet)
+		if err != nil || !bytes.Equal(inner, vec.Inner) {
+			t.Errorf("UnsealHybrid = %x, %v", inner, err)
+		}
+	}
+}
+
+func TestSealHybridRoundTrip(t *testing.T) {
+	priv, err := GenerateHybridKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParseHybridPublicKey(priv.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := append([]byte{Version3}, "inner knock"...)
+
+	packet, err := SealHybrid(pub, SuiteChaCha20Poly1305, inner, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := UnsealHybrid(priv, packet); err != nil || !bytes.Equal(got, inner) {
+		t.Errorf("UnsealHybrid = %q, %v, want %q", got, err, inner)
+	}
+	bad := bytes.Clone(packet)
+	bad[len(bad)-1] ^= 0x01
+	if _, err := UnsealHybrid(priv, bad); err == nil {
+		t.Error("UnsealHybrid of a tampered envelope succeeded")
+	}
+}
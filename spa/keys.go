@@ -0,0 +1,51 @@
+package spa
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Keys holds the keys a knock is encoded or decoded with. Enc and MAC are
+// used by v2 knocks and AEAD by v3 knocks; all three are derived from a
+// master key by DeriveKeys. SignKey and VerifyKey are used by ModeSigned
+// knocks on the client and server respectively.
+type Keys struct {
+	Enc  []byte
+	MAC  []byte
+	AEAD []byte
+
+	SignKey   ed25519.PrivateKey
+	VerifyKey ed25519.PublicKey
+}
+
+// DeriveKeys derives the encryption and MAC keys from a 32-byte master key.
+func DeriveKeys(masterKey []byte) (Keys, error) {
+	if len(masterKey) != KeySize {
+		return Keys{}, ErrKeySize
+	}
+	return Keys{
+		Enc:  hmacSHA256(masterKey, "knockknock-encrypt"),
+		MAC:  hmacSHA256(masterKey, "knockknock-hmac"),
+		AEAD: hmacSHA256(masterKey, "knockknock-v3-aead"),
+	}, nil
+}
+
+func hmacSHA256(key []byte, label string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+// DeriveAgentKey derives the per-agent key of agentID from the master key
+// using HKDF-SHA256. The result is used in place of the master key with
+// DeriveKeys and ModeAgent knocks, so a client never needs the master key.
+func DeriveAgentKey(masterKey []byte, agentID uint64) ([]byte, error) {
+	if len(masterKey) != KeySize {
+		return nil, ErrKeySize
+	}
+	info := binary.BigEndian.AppendUint64([]byte("knockknock-agent"), agentID)
+	return hkdf.Key(sha256.New, masterKey, nil, string(info), KeySize)
+}
@@ -0,0 +1,42 @@
+package spa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDeriveKeys(t *testing.T) {
+	var vectors []struct {
+		MasterKey hexBytes `json:"master_key"`
+		EncKey    hexBytes `json:"enc_key"`
+		MACKey    hexBytes `json:"mac_key"`
+		AEADKey   hexBytes `json:"aead_key"`
+	}
+	loadVectors(t, "derive_keys", &vectors)
+	for _, vec := range vectors {
+		keys, err := DeriveKeys(vec.MasterKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(keys.Enc, vec.EncKey) || !bytes.Equal(keys.MAC, vec.MACKey) || !bytes.Equal(keys.AEAD, vec.AEADKey) {
+			t.Errorf("DeriveKeys(%x) = %x %x %x", vec.MasterKey, keys.Enc, keys.MAC, keys.AEAD)
+		}
+	}
+}
+
+func TestDeriveAgentKey(t *testing.T) {
+	var vectors []struct {
+		MasterKey hexBytes `json:"master_key"`
+		AgentID   hexBytes `json:"agent_id"`
+		AgentKey  hexBytes `json:"agent_key"`
+	}
+	loadVectors(t, "derive_agent_key", &vectors)
+	for _, vec := range vectors {
+		agentID := binary.BigEndian.Uint64(vec.AgentID)
+		key, err := DeriveAgentKey(vec.MasterKey, agentID)
+		if err != nil || !bytes.Equal(key, vec.AgentKey) {
+			t.Errorf("DeriveAgentKey(%x, %x) = %x, %v", vec.MasterKey, agentID, key, err)
+		}
+	}
+}
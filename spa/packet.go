@@ -0,0 +1,55 @@
+package spa
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+)
+
+// NewKnock returns a v3 knock for agentID stamped with the current time and
+// a fresh random nonce.
+func NewKnock(agentID uint64) (*Knock, error) {
+	k := &Knock{
+		Version:   Version3,
+		Suite:     SuiteAES256GCM,
+		Mode:      ModeShared,
+		Timestamp: time.Now(),
+		AgentID:   agentID,
+	}
+	if _, err := rand.Read(k.Nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return k, nil
+}
+
+// Encode encrypts and authenticates k in the format selected by k.Version.
+// IVs are read from random, which is normally crypto/rand.Reader.
+func Encode(keys Keys, k *Knock, random io.Reader) ([]byte, error) {
+	switch k.Version {
+	case Version2:
+		return encodeV2(keys, k, random)
+	case Version3:
+		return encodeV3(keys, k, random)
+	default:
+		return nil, ErrVersion
+	}
+}
+
+// Decode authenticates and decrypts an encoded knock of any supported
+// version. It does not check the timestamp or the nonce; that is up to the
+// caller.
+func Decode(keys Keys, packet []byte) (*Knock, error) {
+	if len(packet) == 0 {
+		return nil, ErrShortPacket
+	}
+	// v3 carries its version in the clear. A v2 ciphertext may start with
+	// the same byte by chance, so fall back to v2 if v3 does not verify.
+	if packet[0] == Version3 {
+		k, err := decodeV3(keys, packet)
+		if err == nil || len(packet) != PacketSizeV2 {
+			return k, err
+		}
+	}
+	return decodeV2(keys, packet)
+}
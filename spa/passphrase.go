@@ -0,0 +1,30 @@
+package spa
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters of DeriveMasterKey. Changing them changes every
+// passphrase-derived key, so they are fixed by the format.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+
+	// SaltSize is the size of the salts generated by kk init.
+	SaltSize = 16
+)
+
+// ErrSaltSize is returned for a salt shorter than SaltSize.
+var ErrSaltSize = errors.New("spa: salt too short")
+
+// DeriveMasterKey derives a master key from a passphrase and a
+// per-deployment salt with Argon2id.
+func DeriveMasterKey(passphrase, salt []byte) ([]byte, error) {
+	if len(salt) < SaltSize {
+		return nil, ErrSaltSize
+	}
+	return argon2.IDKey(passphrase, salt, argonTime, argonMemory, argonThreads, KeySize), nil
+}
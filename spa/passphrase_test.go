@@ -0,0 +1,26 @@
+package spa
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDeriveMasterKey(t *testing.T) {
+	var vectors []struct {
+		Passphrase string   `json:"passphrase"`
+		Salt       hexBytes `json:"salt"`
+		MasterKey  hexBytes `json:"master_key"`
+	}
+	loadVectors(t, "derive_master_key", &vectors)
+	for _, vec := range vectors {
+		key, err := DeriveMasterKey([]byte(vec.Passphrase), vec.Salt)
+		if err != nil || !bytes.Equal(key, vec.MasterKey) {
+			t.Errorf("DeriveMasterKey(%q) = %x, %v", vec.Passphrase, key, err)
+		}
+	}
+
+	if _, err := DeriveMasterKey([]byte("passphrase"), make([]byte, SaltSize-1)); !errors.Is(err, ErrSaltSize) {
+		t.Errorf("DeriveMasterKey with a short salt = %v, want ErrSaltSize", err)
+	}
+}
@@ -0,0 +1,134 @@
+package spa
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const x25519KeySize = 32
+
+// Seal wraps an encoded v3 knock in a ModeSealed envelope encrypted to the
+// server's X25519 public key. A fresh ephemeral key is generated for every
+// envelope, so recording knocks and later stealing the master key or a
+// client key does not reveal their content. Only the server's X25519
+// private key can open them, so a leak of that key exposes every knock
+// sealed to it; servers limit this by using each key for one epoch and
+// erasing it afterwards.
+//
+// Layout: Version(1) | Suite(1) | Mode(1)=3 | ServerKeyID(8) |
+// Ephemeral(32) | IV(12) | CipherText | Tag(16). The header is
+// authenticated as associated data and the plaintext is the inner knock.
+func Seal(serverKey *ecdh.PublicKey, suite byte, inner []byte, random io.Reader) ([]byte, error) {
+	eph, shared, err := x25519Exchange(serverKey, random)
+	if err != nil {
+		return nil, err
+	}
+	header := []byte{Version3, suite, ModeSealed}
+	header = binary.BigEndian.AppendUint64(header, KeyID(serverKey.Bytes()))
+	header = append(header, eph...)
+	return sealEnvelope(header, shared, serverKey.Bytes(), inner, random)
+}
+
+// Unseal opens a ModeSealed envelope with the server's X25519 private key
+// and returns the inner knock, which is then passed to Decode. Use
+// PeekHeader to find the key by its ServerKeyID.
+func Unseal(serverKey *ecdh.PrivateKey, packet []byte) ([]byte, error) {
+	h, sealed, err := parseHeaderV3(packet)
+	if err != nil {
+		return nil, err
+	}
+	if h.Mode != ModeSealed {
+		return nil, ErrMode
+	}
+	pub := serverKey.PublicKey().Bytes()
+	if h.ServerKeyID != KeyID(pub) {
+		return nil, ErrBadMAC
+	}
+	shared, err := x25519Shared(serverKey, h.ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(h, shared, pub, sealed)
+}
+
+// x25519Exchange generates an ephemeral key and returns its public half
+// and the secret shared with serverKey.
+func x25519Exchange(serverKey *ecdh.PublicKey, random io.Reader) ([]byte, []byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	shared, err := eph.ECDH(serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return eph.PublicKey().Bytes(), shared, nil
+}
+
+func x25519Shared(serverKey *ecdh.PrivateKey, ephemeral []byte) ([]byte, error) {
+	eph, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, ErrBadMAC
+	}
+	shared, err := serverKey.ECDH(eph)
+	if err != nil {
+		return nil, ErrBadMAC
+	}
+	return shared, nil
+}
+
+// sealEnvelope appends an IV to header and seals inner with a key derived
+// from secret, the header and the server public key.
+func sealEnvelope(header, secret, serverKey, inner []byte, random io.Reader) ([]byte, error) {
+	if len(inner) == 0 || inner[0] != Version3 {
+		return nil, ErrVersion
+	}
+	header = append(header, make([]byte, ivSizeV3)...)
+	iv := header[len(header)-ivSizeV3:]
+	if _, err := io.ReadFull(random, iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+
+	aead, err := envelopeAEAD(header[1], header[2], secret, header[:len(header)-ivSizeV3], serverKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, iv, inner, header), nil
+}
+
+func openEnvelope(h *Header, secret, serverKey, sealed []byte) ([]byte, error) {
+	aead, err := envelopeAEAD(h.Suite, h.Mode, secret, h.raw[:len(h.raw)-ivSizeV3], serverKey)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := aead.Open(nil, h.iv, sealed, h.raw)
+	if err != nil {
+		return nil, ErrBadMAC
+	}
+	if len(inner) == 0 || inner[0] != Version3 {
+		return nil, ErrBadBody
+	}
+	return inner, nil
+}
+
+// envelopeAEAD derives the envelope key with HKDF-SHA256 over the shared
+// secret, binding it to the key exchange fields of the header and to the
+// server public key.
+func envelopeAEAD(suite, mode byte, secret, header, serverKey []byte) (cipher.AEAD, error) {
+	label := "knockknock-sealed"
+	if mode == ModeHybrid {
+		label = "knockknock-hybrid"
+	}
+	info := append([]byte(label), header[3+8:]...) // ephemeral key and KEM ciphertext
+	info = append(info, serverKey...)
+	key, err := hkdf.Key(sha256.New, secret, nil, string(info), KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(suite, key)
+}
@@ -0,0 +1,59 @@
+package spa
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSealedVectors(t *testing.T) {
+	var vectors []struct {
+		ServerPrivateKey hexBytes `json:"server_private_key"`
+		ServerPublicKey  hexBytes `json:"server_public_key"`
+		Packet           hexBytes `json:"packet"`
+		Inner            hexBytes `json:"inner"`
+	}
+	loadVectors(t, "v3_sealed", &vectors)
+	for _, vec := range vectors {
+		priv, err := ecdh.X25519().NewPrivateKey(vec.ServerPrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(priv.PublicKey().Bytes(), vec.ServerPublicKey) {
+			t.Errorf("server public key = %x, want %x", priv.PublicKey().Bytes(), vec.ServerPublicKey)
+		}
+		inner, err := Unseal(priv, vec.Packet)
+		if err != nil || !bytes.Equal(inner, vec.Inner) {
+			t.Errorf("Unseal = %x, %v", inner, err)
+		}
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := append([]byte{Version3}, "inner knock"...)
+
+	packet, err := Seal(priv.PublicKey(), SuiteAES256GCM, inner, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Unseal(priv, packet); err != nil || !bytes.Equal(got, inner) {
+		t.Errorf("Unseal = %q, %v, want %q", got, err, inner)
+	}
+	if _, err := Unseal(other, packet); err == nil {
+		t.Error("Unseal with another server key succeeded")
+	}
+	bad := bytes.Clone(packet)
+	bad[len(bad)-1] ^= 0x01
+	if _, err := Unseal(priv, bad); err == nil {
+		t.Error("Unseal of a tampered envelope succeeded")
+	}
+}
@@ -0,0 +1,54 @@
+package spa
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// KeyID returns the ID of a public key: the first 8 bytes of its SHA-256
+// hash. Signed knocks carry the ID of the Ed25519 client key and use it as
+// their agent ID; sealed envelopes carry the ID of the X25519 server key.
+func KeyID(pub []byte) uint64 {
+	sum := sha256.Sum256(pub)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// encodeSigned signs k with keys.SignKey. k.AgentID must be the KeyID of
+// the signing key.
+func encodeSigned(keys Keys, k *Knock) ([]byte, error) {
+	if len(keys.SignKey) != ed25519.PrivateKeySize {
+		return nil, ErrKeySize
+	}
+	if k.AgentID != KeyID(keys.SignKey.Public().(ed25519.PublicKey)) {
+		return nil, ErrBadBody
+	}
+
+	packet := []byte{Version3, SuiteNone, ModeSigned}
+	packet = binary.BigEndian.AppendUint64(packet, k.AgentID)
+	body, err := encodeBody(k)
+	if err != nil {
+		return nil, err
+	}
+	packet = append(packet, body...)
+	return append(packet, ed25519.Sign(keys.SignKey, packet)...), nil
+}
+
+// verifySigned checks the signature of a signed knock with keys.VerifyKey
+// and returns its body.
+func verifySigned(keys Keys, h *Header, rest []byte) ([]byte, error) {
+	if len(keys.VerifyKey) != ed25519.PublicKeySize {
+		return nil, ErrKeySize
+	}
+	if KeyID(keys.VerifyKey) != h.AgentID {
+		return nil, ErrBadMAC
+	}
+	split := len(rest) - ed25519.SignatureSize
+	body, sig := rest[:split], rest[split:]
+	signed := make([]byte, 0, len(h.raw)+len(body))
+	signed = append(append(signed, h.raw...), body...)
+	if !ed25519.Verify(keys.VerifyKey, signed, sig) {
+		return nil, ErrBadMAC
+	}
+	return body, nil
+}
@@ -0,0 +1,54 @@
+package spa
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSignedVectors(t *testing.T) {
+	var vectors []struct {
+		Seed        hexBytes `json:"ed25519_seed"`
+		PublicKey   hexBytes `json:"public_key"`
+		KeyID       hexBytes `json:"key_id"`
+		Nonce       hexBytes `json:"nonce"`
+		TimestampMS int64    `json:"timestamp_ms"`
+		Packet      hexBytes `json:"packet"`
+	}
+	loadVectors(t, "v3_signed", &vectors)
+	for _, vec := range vectors {
+		priv := ed25519.NewKeyFromSeed(vec.Seed)
+		pub := priv.Public().(ed25519.PublicKey)
+		if !bytes.Equal(pub, vec.PublicKey) {
+			t.Fatalf("public key = %x, want %x", pub, vec.PublicKey)
+		}
+		k := &Knock{Version: Version3, Suite: SuiteNone, Mode: ModeSigned, Timestamp: time.UnixMilli(vec.TimestampMS), AgentID: KeyID(pub)}
+		copy(k.Nonce[:], vec.Nonce)
+		if !bytes.Equal(vec.KeyID, vec.Packet[3:11]) {
+			t.Errorf("key_id %x does not match the packet header", vec.KeyID)
+		}
+
+		got, err := Decode(Keys{VerifyKey: pub}, vec.Packet)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if !reflect.DeepEqual(got, k) {
+			t.Errorf("Decode = %+v, want %+v", got, k)
+		}
+		packet, err := Encode(Keys{SignKey: priv}, k, nil)
+		if err != nil || !bytes.Equal(packet, vec.Packet) {
+			t.Errorf("Encode = %x, %v, want %x", packet, err, vec.Packet)
+		}
+
+		// The signature covers the header and the body
+		for _, i := range []int{3, len(packet) - ed25519.SignatureSize - 1, len(packet) - 1} {
+			bad := bytes.Clone(vec.Packet)
+			bad[i] ^= 0x01
+			if _, err := Decode(Keys{VerifyKey: pub}, bad); err == nil {
+				t.Errorf("Decode with byte %d flipped succeeded", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package spa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// hexBytes is a byte string hex encoded in vectors.json.
+type hexBytes []byte
+
+func (h *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	*h = b
+	return err
+}
+
+// loadVectors decodes the section name of vectors.json into v.
+func loadVectors(t *testing.T, name string, v any) {
+	t.Helper()
+	data, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		t.Fatal(err)
+	}
+	section, ok := sections[name]
+	if !ok {
+		t.Fatalf("no %s section in vectors.json", name)
+	}
+	if err := json.Unmarshal(section, v); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
+
+// vectorAddr returns addr in the form Decode returns it.
+func vectorAddr(addr string) net.IP {
+	if addr == "" {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// knockVector is a knock encoded with a fixed nonce and IV.
+type knockVector struct {
+	MasterKey   hexBytes `json:"master_key"`
+	AgentKey    hexBytes `json:"agent_key"`
+	AgentID     hexBytes `json:"agent_id"`
+	Nonce       hexBytes `json:"nonce"`
+	IV          hexBytes `json:"iv"`
+	Packet      hexBytes `json:"packet"`
+	Timestamp   int64    `json:"timestamp"`
+	TimestampMS int64    `json:"timestamp_ms"`
+	Suite       byte     `json:"suite"`
+	Mode        byte     `json:"mode"`
+	Extra       []struct {
+		Type  byte     `json:"type"`
+		Value hexBytes `json:"value"`
+	} `json:"extra"`
+	KeyID      uint32   `json:"key_id"`
+	OTP        string   `json:"otp"`
+	Close      bool     `json:"close"`
+	Counter    uint64   `json:"counter"`
+	TTLSeconds int64    `json:"ttl_seconds"`
+	Services   []string `json:"services"`
+	ClientAddr string   `json:"client_addr"`
+	AnySource  bool     `json:"any_source"`
+	ServerAddr string   `json:"server_addr"`
+	ServerID   string   `json:"server_id"`
+}
+
+// knockSections are the sections of vectors.json holding knockVectors.
+var knockSections = []string{"v2", "v3", "v3_bound", "v3_source", "v3_services", "v3_ttl", "v3_close", "v3_otp", "v3_key_id"}
+
+// knock returns the keys and the knock described by v.
+func (v *knockVector) knock(t *testing.T) (Keys, *Knock) {
+	t.Helper()
+	master := v.MasterKey
+	if v.Mode == ModeAgent {
+		master = v.AgentKey
+	}
+	keys, err := DeriveKeys(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &Knock{
+		Version:    Version3,
+		Suite:      v.Suite,
+		Mode:       v.Mode,
+		Timestamp:  time.UnixMilli(v.TimestampMS),
+		ServerAddr: vectorAddr(v.ServerAddr),
+		ServerID:   v.ServerID,
+		ClientAddr: vectorAddr(v.ClientAddr),
+		AnySource:  v.AnySource,
+		Services:   v.Services,
+		TTL:        time.Duration(v.TTLSeconds) * time.Second,
+		Close:      v.Close,
+		Counter:    v.Counter,
+		OTP:        v.OTP,
+		KeyID:      v.KeyID,
+	}
+	if v.Timestamp != 0 {
+		k.Version = Version2
+		k.Timestamp = time.Unix(v.Timestamp, 0)
+	}
+	k.AgentID = binary.BigEndian.Uint64(v.AgentID)
+	copy(k.Nonce[:], v.Nonce)
+	for _, f := range v.Extra {
+		k.Extra = append(k.Extra, Field{Type: f.Type, Value: f.Value})
+	}
+	return keys, k
+}
+
+func TestKnockVectors(t *testing.T) {
+	for _, name := range knockSections {
+		var section []knockVector
+		loadVectors(t, name, &section)
+		if len(section) == 0 {
+			t.Errorf("%s: no vectors", name)
+		}
+		for i, vec := range section {
+			keys, want := vec.knock(t)
+
+			got, err := Decode(keys, vec.Packet)
+			if err != nil {
+				t.Errorf("%s[%d]: Decode: %v", name, i, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s[%d]: Decode = %+v, want %+v", name, i, got, want)
+			}
+
+			packet, err := Encode(keys, want, bytes.NewReader(vec.IV))
+			if err != nil {
+				t.Errorf("%s[%d]: Encode: %v", name, i, err)
+				continue
+			}
+			if !bytes.Equal(packet, vec.Packet) {
+				t.Errorf("%s[%d]: Encode = %x, want %x", name, i, packet, vec.Packet)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	master := make([]byte, KeySize)
+	if _, err := rand.Read(master); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := DeriveKeys(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		version byte
+		suite   byte
+		tag     int // offset of the MAC or tag, negative from the end
+	}{
+		{"v2", Version2, SuiteNone, plainSizeV2},
+		{"v3 AES-256-GCM", Version3, SuiteAES256GCM, -tagSizeV3},
+		{"v3 ChaCha20-Poly1305", Version3, SuiteChaCha20Poly1305, -tagSizeV3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKnock(0x0102030405060708)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k.Version, k.Suite = tt.version, tt.suite
+			if tt.version == Version2 {
+				k.Timestamp = time.Unix(k.Timestamp.Unix(), 0)
+			} else {
+				k.Timestamp = time.UnixMilli(k.Timestamp.UnixMilli())
+			}
+
+			packet, err := Encode(keys, k, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Decode(keys, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, k) {
+				t.Errorf("Decode = %+v, want %+v", got, k)
+			}
+
+			// Flip one bit in the ciphertext and one in the MAC or tag
+			tag := tt.tag
+			if tag < 0 {
+				tag += len(packet)
+			}
+			for _, i := range []int{tag - 1, tag} {
+				bad := bytes.Clone(packet)
+				bad[i] ^= 0x01
+				if _, err := Decode(keys, bad); !errors.Is(err, ErrBadMAC) {
+					t.Errorf("Decode with bit %d flipped = %v, want ErrBadMAC", i*8, err)
+				}
+			}
+		})
+	}
+}
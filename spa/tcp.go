@@ -0,0 +1,150 @@
+package spa
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// OptionKindExperiment is the shared experimental TCP option kind
+	// (RFC 6994) used to mark a SYN as a knock.
+	OptionKindExperiment = 254
+	// ExperimentID is the 16-bit experiment identifier ("KK") carried in
+	// the experimental option.
+	ExperimentID = 0x4b4b
+)
+
+var (
+	// ErrNoKnock is returned when a TCP segment does not carry a knock.
+	ErrNoKnock = errors.New("spa: no knock in packet")
+	// ErrBadOption is returned when the TCP options cannot be parsed.
+	ErrBadOption = errors.New("spa: malformed TCP options")
+)
+
+// WalkOptions walks raw TCP option bytes and calls fn with the kind and
+// data of every option up to End of Option List. Walking stops early when
+// fn returns false.
+func WalkOptions(opts []byte, fn func(kind byte, data []byte) bool) error {
+	for len(opts) > 0 {
+		kind := opts[0]
+		switch kind {
+		case byte(layers.TCPOptionKindEndList):
+			return nil
+		case byte(layers.TCPOptionKindNop):
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 {
+			return ErrBadOption
+		}
+		length := int(opts[1])
+		if length < 2 || length > len(opts) {
+			return ErrBadOption
+		}
+		if !fn(kind, opts[2:length]) {
+			return nil
+		}
+		opts = opts[length:]
+	}
+	return nil
+}
+
+// SYN layout. The encoded knock is spread over the fields below in order;
+// whatever does not fit travels as SYN data.
+//
+//	IP ID(2) | Seq(4) | Ack(4) | Window(2) | UrgPtr(2) | TSval(4) | Exp(16) | SYN data
+//
+// The options are laid out the way common stacks do, so the SYN stays
+// within the 40-byte option limit:
+//
+//	MSS(4) | SACK-permitted(2) | Timestamps(10) | NOP(1) | WScale(3) | Exp(20)
+const (
+	synMSS        = 1460
+	synWScale     = 7
+	expDataSize   = 16
+	synHeaderSize = 2 + 4 + 4 + 2 + 2 + 4 + expDataSize
+)
+
+// EncodeSYN spreads an encoded knock over the header fields of ip and tcp
+// and returns the remainder to be sent as SYN data. ip may be nil, in which
+// case its bytes move to the SYN data instead.
+func EncodeSYN(packet []byte, ip *layers.IPv4, tcp *layers.TCP) ([]byte, error) {
+	if len(packet) < synHeaderSize {
+		return nil, ErrShortPacket
+	}
+	b := packet
+	if ip != nil {
+		ip.Id = binary.BigEndian.Uint16(b)
+		b = b[2:]
+	}
+	tcp.SYN = true
+	tcp.ACK = false
+	tcp.Seq = binary.BigEndian.Uint32(b)
+	tcp.Ack = binary.BigEndian.Uint32(b[4:])
+	tcp.Window = binary.BigEndian.Uint16(b[8:])
+	tcp.Urgent = binary.BigEndian.Uint16(b[10:])
+	b = b[12:]
+
+	mss := make([]byte, 2)
+	binary.BigEndian.PutUint16(mss, synMSS)
+	ts := make([]byte, 8) // TSecr stays zero in a SYN
+	copy(ts, b[:4])
+	exp := make([]byte, 2+expDataSize)
+	binary.BigEndian.PutUint16(exp, ExperimentID)
+	copy(exp[2:], b[4:4+expDataSize])
+	b = b[4+expDataSize:]
+
+	tcp.Options = []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: mss},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: ts},
+		{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{synWScale}},
+		{OptionType: OptionKindExperiment, OptionLength: byte(2 + len(exp)), OptionData: exp},
+	}
+	return b, nil
+}
+
+// DecodeSYN reassembles an encoded knock from a TCP SYN built by
+// EncodeSYN. ip must be nil if the knock was encoded without one.
+func DecodeSYN(ip *layers.IPv4, tcp *layers.TCP) ([]byte, error) {
+	if !tcp.SYN || tcp.ACK {
+		return nil, ErrNoKnock
+	}
+	if len(tcp.Contents) < 20 {
+		return nil, ErrBadOption
+	}
+
+	var tsval, exp []byte
+	err := WalkOptions(tcp.Contents[20:], func(kind byte, data []byte) bool {
+		switch {
+		case kind == byte(layers.TCPOptionKindTimestamps) && len(data) == 8:
+			tsval = data[:4]
+		case kind == OptionKindExperiment && len(data) == 2+expDataSize &&
+			binary.BigEndian.Uint16(data) == ExperimentID:
+			exp = data[2:]
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tsval == nil || exp == nil {
+		return nil, ErrNoKnock
+	}
+
+	packet := make([]byte, 0, synHeaderSize+len(tcp.Payload))
+	if ip != nil {
+		packet = binary.BigEndian.AppendUint16(packet, ip.Id)
+	}
+	packet = binary.BigEndian.AppendUint32(packet, tcp.Seq)
+	packet = binary.BigEndian.AppendUint32(packet, tcp.Ack)
+	packet = binary.BigEndian.AppendUint16(packet, tcp.Window)
+	packet = binary.BigEndian.AppendUint16(packet, tcp.Urgent)
+	packet = append(packet, tsval...)
+	packet = append(packet, exp...)
+	packet = append(packet, tcp.Payload...)
+	return packet, nil
+}
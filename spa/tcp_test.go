@@ -0,0 +1,181 @@
+package spa
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type option struct {
+	kind byte
+	data []byte
+}
+
+func walk(t *testing.T, opts []byte) ([]option, error) {
+	t.Helper()
+	var got []option
+	err := WalkOptions(opts, func(kind byte, data []byte) bool {
+		got = append(got, option{kind, data})
+		return true
+	})
+	return got, err
+}
+
+func TestWalkOptions(t *testing.T) {
+	tcp := &layers.TCP{
+		SrcPort: 40000,
+		DstPort: 80,
+		SYN:     true,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+			{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+			{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, tcp); err != nil {
+		t.Fatal(err)
+	}
+	parsed := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeTCP, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	got, err := walk(t, parsed.Contents[20:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []option{
+		{byte(layers.TCPOptionKindMSS), []byte{0x05, 0xb4}},
+		{byte(layers.TCPOptionKindWindowScale), []byte{7}},
+		{byte(layers.TCPOptionKindSACKPermitted), []byte{}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("WalkOptions found %d options, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].kind != want[i].kind || !bytes.Equal(got[i].data, want[i].data) {
+			t.Errorf("option %d = %d %x, want %d %x", i, got[i].kind, got[i].data, want[i].kind, want[i].data)
+		}
+	}
+}
+
+func TestWalkOptionsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []byte
+		n    int
+		err  error
+	}{
+		{"end of list", []byte{1, 0, 2, 4, 5, 0xb4}, 0, nil},
+		{"missing length", []byte{1, 2}, 0, ErrBadOption},
+		{"length too short", []byte{2, 1, 0, 0}, 0, ErrBadOption},
+		{"length past the end", []byte{3, 3, 7, 2, 4, 5}, 1, ErrBadOption},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := walk(t, tt.opts)
+			if !errors.Is(err, tt.err) || len(got) != tt.n {
+				t.Errorf("WalkOptions = %d options, %v, want %d, %v", len(got), err, tt.n, tt.err)
+			}
+		})
+	}
+}
+
+func TestWalkOptionsStop(t *testing.T) {
+	n := 0
+	err := WalkOptions([]byte{3, 3, 7, 4, 2}, func(kind byte, data []byte) bool {
+		n++
+		return false
+	})
+	if err != nil || n != 1 {
+		t.Errorf("WalkOptions = %d calls, %v, want 1, nil", n, err)
+	}
+}
+
+// serializeSYN serializes a SYN carrying packet and parses it back.
+func serializeSYN(t *testing.T, packet []byte, ipv6 bool) (*layers.IPv4, *layers.TCP) {
+	t.Helper()
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80}
+	var network gopacket.SerializableLayer
+	var ip *layers.IPv4
+	if ipv6 {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+			SrcIP: vectorAddr("2001:db8::2"), DstIP: vectorAddr("2001:db8::1")}
+		tcp.SetNetworkLayerForChecksum(ip6)
+		network = ip6
+	} else {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+			SrcIP: vectorAddr("192.0.2.2"), DstIP: vectorAddr("192.0.2.1")}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	}
+
+	synData, err := EncodeSYN(packet, ip, tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, network, tcp, gopacket.Payload(synData)); err != nil {
+		t.Fatal(err)
+	}
+
+	first := layers.LayerTypeIPv4
+	if ipv6 {
+		first = layers.LayerTypeIPv6
+	}
+	pkt := gopacket.NewPacket(buf.Bytes(), first, gopacket.Default)
+	if ipv4, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		ip = ipv4
+	}
+	return ip, pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+}
+
+func TestSYNRoundTrip(t *testing.T) {
+	for _, size := range []int{synHeaderSize, PacketSizeV2, 200} {
+		for _, ipv6 := range []bool{false, true} {
+			packet := make([]byte, size)
+			for i := range packet {
+				packet[i] = byte(i + 1)
+			}
+			ip, tcp := serializeSYN(t, packet, ipv6)
+
+			if optLen := len(tcp.Contents) - 20; optLen > 40 {
+				t.Errorf("size %d: %d bytes of TCP options, want at most 40", size, optLen)
+			}
+			got, err := DecodeSYN(ip, tcp)
+			if err != nil {
+				t.Fatalf("size %d, IPv6 %v: DecodeSYN: %v", size, ipv6, err)
+			}
+			if !bytes.Equal(got, packet) {
+				t.Errorf("size %d, IPv6 %v: DecodeSYN = %x, want %x", size, ipv6, got, packet)
+			}
+		}
+	}
+}
+
+func TestDecodeSYNNoKnock(t *testing.T) {
+	ip, tcp := serializeSYN(t, make([]byte, synHeaderSize), false)
+	tcp.ACK = true
+	if _, err := DecodeSYN(ip, tcp); !errors.Is(err, ErrNoKnock) {
+		t.Errorf("DecodeSYN of a SYN-ACK = %v, want ErrNoKnock", err)
+	}
+
+	plain := &layers.TCP{SrcPort: 40000, DstPort: 80, SYN: true, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+	}}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, plain); err != nil {
+		t.Fatal(err)
+	}
+	tcp = gopacket.NewPacket(buf.Bytes(), layers.LayerTypeTCP, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if _, err := DecodeSYN(nil, tcp); !errors.Is(err, ErrNoKnock) {
+		t.Errorf("DecodeSYN of a plain SYN = %v, want ErrNoKnock", err)
+	}
+
+	if _, err := EncodeSYN(make([]byte, synHeaderSize-1), nil, &layers.TCP{}); !errors.Is(err, ErrShortPacket) {
+		t.Errorf("EncodeSYN of a short knock = %v, want ErrShortPacket", err)
+	}
+}
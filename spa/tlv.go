@@ -0,0 +1,253 @@
+package spa
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// Field types of the v3 body. The body is a sequence of
+// Type(1) | Length(1) | Value fields. Types with FieldCritical set must be
+// understood by the receiver; unknown non-critical fields are skipped.
+const (
+	FieldCritical = 0x80
+
+	FieldTimestamp = FieldCritical | 0x01 // Unix ms, 8 bytes
+	FieldAgentID   = FieldCritical | 0x02 // 8 bytes
+	FieldNonce     = FieldCritical | 0x03 // NonceSize bytes
+
+	// FieldServices lists the requested services, separated by commas. It
+	// is critical so that a server which does not know it rejects the knock
+	// instead of granting all ports.
+	FieldServices = FieldCritical | 0x04 // 1..255 bytes
+
+	// FieldClose asks the server to revoke the agent's open grants instead
+	// of opening the door. It is critical so that older servers do not
+	// treat it as an ordinary knock.
+	FieldClose = FieldCritical | 0x05 // 0 bytes
+
+	// The server binding fields are non-critical so that servers which do
+	// not check them keep accepting bound knocks.
+	FieldServerAddr = 0x04 // 4 or 16 bytes
+	FieldServerID   = 0x05 // 1..255 bytes
+
+	// FieldClientAddr is the address the client wants to be granted. An
+	// empty value asks the server to use the packet source (NAT mode).
+	FieldClientAddr = 0x06 // 0, 4 or 16 bytes
+
+	// FieldTTL is the requested grant duration in seconds. It is only a
+	// hint; the server may grant less.
+	FieldTTL = 0x07 // 4 bytes
+
+	// FieldCounter is a per-agent counter that must increase with every
+	// knock, so that replays are caught across server restarts.
+	FieldCounter = 0x08 // 8 bytes
+
+	// FieldOTP is a one-time code used as a second factor.
+	FieldOTP = 0x09 // 1..255 bytes
+)
+
+var (
+	// ErrBadBody is returned when the v3 body is not a valid field list.
+	ErrBadBody = errors.New("spa: malformed knock body")
+	// ErrCriticalField is returned for an unknown critical field.
+	ErrCriticalField = errors.New("spa: unknown critical field")
+	// ErrLegacyFields is returned when extra fields are set on a v2 knock.
+	ErrLegacyFields = errors.New("spa: v2 knocks cannot carry extra fields")
+)
+
+// Field is a raw type-length-value field of the v3 body.
+type Field struct {
+	Type  byte
+	Value []byte
+}
+
+// Critical reports whether the receiver must understand the field.
+func (f Field) Critical() bool {
+	return f.Type&FieldCritical != 0
+}
+
+// hasFields reports whether k carries any of the optional v3 fields or a
+// key ID hint.
+func (k *Knock) hasFields() bool {
+	return k.KeyID != 0 || k.ServerAddr != nil || k.ServerID != "" || k.ClientAddr != nil || k.AnySource ||
+		len(k.Services) > 0 || k.Close || k.TTL != 0 || k.Counter != 0 || k.OTP != "" || len(k.Extra) > 0
+}
+
+func appendField(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ, byte(len(value)))
+	return append(b, value...)
+}
+
+// encodeBody serializes the fields of k into a v3 body.
+func encodeBody(k *Knock) ([]byte, error) {
+	var b []byte
+	b = appendField(b, FieldTimestamp, binary.BigEndian.AppendUint64(nil, uint64(k.Timestamp.UnixMilli())))
+	b = appendField(b, FieldAgentID, binary.BigEndian.AppendUint64(nil, k.AgentID))
+	b = appendField(b, FieldNonce, k.Nonce[:])
+	if k.ServerAddr != nil {
+		addr, ok := addrValue(k.ServerAddr)
+		if !ok {
+			return nil, ErrBadBody
+		}
+		b = appendField(b, FieldServerAddr, addr)
+	}
+	if k.ServerID != "" {
+		if len(k.ServerID) > 255 {
+			return nil, ErrBadBody
+		}
+		b = appendField(b, FieldServerID, []byte(k.ServerID))
+	}
+	if len(k.Services) > 0 {
+		for _, name := range k.Services {
+			if name == "" || strings.Contains(name, ",") {
+				return nil, ErrBadBody
+			}
+		}
+		list := strings.Join(k.Services, ",")
+		if len(list) > 255 {
+			return nil, ErrBadBody
+		}
+		b = appendField(b, FieldServices, []byte(list))
+	}
+	if k.OTP != "" {
+		if len(k.OTP) > 255 {
+			return nil, ErrBadBody
+		}
+		b = appendField(b, FieldOTP, []byte(k.OTP))
+	}
+	if k.Counter != 0 {
+		b = appendField(b, FieldCounter, binary.BigEndian.AppendUint64(nil, k.Counter))
+	}
+	if k.Close {
+		b = appendField(b, FieldClose, nil)
+	}
+	if k.TTL != 0 {
+		secs := (k.TTL + time.Second - 1) / time.Second
+		if k.TTL < 0 || secs > math.MaxUint32 {
+			return nil, ErrBadBody
+		}
+		b = appendField(b, FieldTTL, binary.BigEndian.AppendUint32(nil, uint32(secs)))
+	}
+	switch {
+	case k.AnySource && k.ClientAddr != nil:
+		return nil, ErrBadBody
+	case k.AnySource:
+		b = appendField(b, FieldClientAddr, nil)
+	case k.ClientAddr != nil:
+		addr, ok := addrValue(k.ClientAddr)
+		if !ok {
+			return nil, ErrBadBody
+		}
+		b = appendField(b, FieldClientAddr, addr)
+	}
+	for _, f := range k.Extra {
+		if len(f.Value) > 255 {
+			return nil, ErrBadBody
+		}
+		b = appendField(b, f.Type, f.Value)
+	}
+	return b, nil
+}
+
+// addrValue returns the 4 or 16 byte field value of addr.
+func addrValue(addr net.IP) ([]byte, bool) {
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4, true
+	}
+	return addr, len(addr) == net.IPv6len
+}
+
+// decodeBody parses a v3 body into k. Unknown non-critical fields are kept
+// in k.Extra.
+func decodeBody(k *Knock, b []byte) error {
+	var seen [256]bool
+	for len(b) > 0 {
+		if len(b) < 2 || int(b[1]) > len(b)-2 {
+			return ErrBadBody
+		}
+		f := Field{Type: b[0], Value: b[2 : 2+int(b[1])]}
+		b = b[2+len(f.Value):]
+
+		if seen[f.Type] {
+			return ErrBadBody
+		}
+		seen[f.Type] = true
+
+		switch f.Type {
+		case FieldTimestamp:
+			if len(f.Value) != 8 {
+				return ErrBadBody
+			}
+			k.Timestamp = time.UnixMilli(int64(binary.BigEndian.Uint64(f.Value)))
+		case FieldAgentID:
+			if len(f.Value) != 8 {
+				return ErrBadBody
+			}
+			k.AgentID = binary.BigEndian.Uint64(f.Value)
+		case FieldNonce:
+			if len(f.Value) != NonceSize {
+				return ErrBadBody
+			}
+			copy(k.Nonce[:], f.Value)
+		case FieldServices:
+			k.Services = strings.Split(string(f.Value), ",")
+			for _, name := range k.Services {
+				if name == "" {
+					return ErrBadBody
+				}
+			}
+		case FieldOTP:
+			if len(f.Value) == 0 {
+				return ErrBadBody
+			}
+			k.OTP = string(f.Value)
+		case FieldCounter:
+			if len(f.Value) != 8 {
+				return ErrBadBody
+			}
+			k.Counter = binary.BigEndian.Uint64(f.Value)
+		case FieldClose:
+			if len(f.Value) != 0 {
+				return ErrBadBody
+			}
+			k.Close = true
+		case FieldTTL:
+			if len(f.Value) != 4 {
+				return ErrBadBody
+			}
+			k.TTL = time.Duration(binary.BigEndian.Uint32(f.Value)) * time.Second
+		case FieldServerAddr:
+			if len(f.Value) != net.IPv4len && len(f.Value) != net.IPv6len {
+				return ErrBadBody
+			}
+			k.ServerAddr = net.IP(append([]byte(nil), f.Value...))
+		case FieldServerID:
+			if len(f.Value) == 0 {
+				return ErrBadBody
+			}
+			k.ServerID = string(f.Value)
+		case FieldClientAddr:
+			switch len(f.Value) {
+			case 0:
+				k.AnySource = true
+			case net.IPv4len, net.IPv6len:
+				k.ClientAddr = net.IP(append([]byte(nil), f.Value...))
+			default:
+				return ErrBadBody
+			}
+		default:
+			if f.Critical() {
+				return ErrCriticalField
+			}
+			k.Extra = append(k.Extra, f)
+		}
+	}
+	if !seen[FieldTimestamp] || !seen[FieldAgentID] || !seen[FieldNonce] {
+		return ErrBadBody
+	}
+	return nil
+}
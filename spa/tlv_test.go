@@ -0,0 +1,85 @@
+package spa
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testBody returns the encoded body of a minimal knock followed by extra.
+func testBody(t *testing.T, extra ...byte) []byte {
+	t.Helper()
+	k := &Knock{Timestamp: time.UnixMilli(1700000000123), AgentID: 0x0102030405060708}
+	b, err := encodeBody(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, extra...)
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		err  error
+	}{
+		{"minimal", testBody(t), nil},
+		{"unknown non-critical field", testBody(t, 0x7f, 2, 'h', 'i'), nil},
+		{"unknown critical field", testBody(t, 0xff, 0), ErrCriticalField},
+		{"duplicate field", testBody(t, FieldAgentID, 8, 0, 0, 0, 0, 0, 0, 0, 1), ErrBadBody},
+		{"duplicate unknown field", testBody(t, 0x7f, 0, 0x7f, 0), ErrBadBody},
+		{"truncated length", testBody(t, FieldOTP), ErrBadBody},
+		{"truncated value", testBody(t, FieldOTP, 6, '1', '2', '3'), ErrBadBody},
+		{"wrong field size", testBody(t, FieldTTL, 2, 0, 1), ErrBadBody},
+		{"empty services", testBody(t, FieldServices, 4, 's', 's', 'h', ','), ErrBadBody},
+		{"missing nonce", testBody(t)[:2+8+2+8], ErrBadBody},
+		{"empty", nil, ErrBadBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var k Knock
+			if err := decodeBody(&k, tt.body); !errors.Is(err, tt.err) {
+				t.Errorf("decodeBody = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyExtra(t *testing.T) {
+	var k Knock
+	if err := decodeBody(&k, testBody(t, 0x7f, 2, 'h', 'i', 0x7e, 0)); err != nil {
+		t.Fatal(err)
+	}
+	want := []Field{{Type: 0x7f, Value: []byte("hi")}, {Type: 0x7e, Value: []byte{}}}
+	if !reflect.DeepEqual(k.Extra, want) {
+		t.Errorf("Extra = %v, want %v", k.Extra, want)
+	}
+}
+
+func TestBodyRoundTrip(t *testing.T) {
+	want := &Knock{
+		Timestamp:  time.UnixMilli(1700000000123),
+		AgentID:    0x0102030405060708,
+		ServerAddr: vectorAddr("2001:db8::1"),
+		ServerID:   "web1",
+		ClientAddr: vectorAddr("198.51.100.7"),
+		Services:   []string{"ssh", "rdp"},
+		Counter:    42,
+		OTP:        "287082",
+		Close:      true,
+		TTL:        5 * time.Minute,
+		Extra:      []Field{{Type: 0x7f, Value: []byte("x")}},
+	}
+	b, err := encodeBody(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Knock{}
+	if err := decodeBody(got, b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeBody = %+v, want %+v", got, want)
+	}
+}
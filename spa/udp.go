@@ -0,0 +1,40 @@
+package spa
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// minKnockPort is the lowest port KnockPort picks, to stay clear of the
+// well-known services.
+const minKnockPort = 1024
+
+// EncodeUDP returns the payload of a UDP datagram or ICMP echo request
+// carrying an encoded knock: the experiment identifier ExperimentID followed
+// by the knock.
+func EncodeUDP(packet []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, ExperimentID), packet...)
+}
+
+// DecodeUDP returns the knock carried by a UDP or ICMP echo payload built by
+// EncodeUDP.
+func DecodeUDP(payload []byte) ([]byte, error) {
+	if len(payload) < 2 || binary.BigEndian.Uint16(payload) != ExperimentID {
+		return nil, ErrNoKnock
+	}
+	return payload[2:], nil
+}
+
+// KnockPort derives the UDP port knocks are sent to from the master key, so
+// that clients and servers sharing a key agree on it without configuration.
+func KnockPort(masterKey []byte) (uint16, error) {
+	if len(masterKey) != KeySize {
+		return 0, ErrKeySize
+	}
+	b, err := hkdf.Key(sha256.New, masterKey, nil, "knockknock-udp-port", 2)
+	if err != nil {
+		return 0, err
+	}
+	return minKnockPort + binary.BigEndian.Uint16(b)%(65536-minKnockPort), nil
+}
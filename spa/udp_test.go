@@ -0,0 +1,35 @@
+package spa
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKnockPort(t *testing.T) {
+	var vectors []struct {
+		MasterKey hexBytes `json:"master_key"`
+		UDPPort   uint16   `json:"udp_port"`
+	}
+	loadVectors(t, "knock_port", &vectors)
+	for _, vec := range vectors {
+		port, err := KnockPort(vec.MasterKey)
+		if err != nil || port != vec.UDPPort {
+			t.Errorf("KnockPort(%x) = %d, %v, want %d", vec.MasterKey, port, err, vec.UDPPort)
+		}
+	}
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+	packet := []byte{Version3, 0x01, 0x02}
+	got, err := DecodeUDP(EncodeUDP(packet))
+	if err != nil || !bytes.Equal(got, packet) {
+		t.Errorf("DecodeUDP(EncodeUDP(%x)) = %x, %v", packet, got, err)
+	}
+
+	for _, payload := range [][]byte{nil, {0x12}, {0x00, 0x00, Version3}} {
+		if _, err := DecodeUDP(payload); !errors.Is(err, ErrNoKnock) {
+			t.Errorf("DecodeUDP(%x) = %v, want ErrNoKnock", payload, err)
+		}
+	}
+}
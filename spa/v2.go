@@ -0,0 +1,81 @@
+package spa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// encodeV2 encrypts and authenticates k in the legacy v2 format.
+//
+// Layout: CipherText(29) | MAC(16) | IV(16), where the MAC is a truncated
+// HMAC-SHA256 over the ciphertext.
+func encodeV2(keys Keys, k *Knock, random io.Reader) ([]byte, error) {
+	if k.hasFields() {
+		return nil, ErrLegacyFields
+	}
+
+	plainText := make([]byte, plainSizeV2)
+	plainText[0] = k.Version
+	binary.BigEndian.PutUint32(plainText[1:5], uint32(k.Timestamp.Unix()))
+	binary.BigEndian.PutUint64(plainText[5:13], k.AgentID)
+	copy(plainText[13:], k.Nonce[:])
+
+	packet := make([]byte, PacketSizeV2)
+	iv := packet[plainSizeV2+macSizeV2:]
+	if _, err := io.ReadFull(random, iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+	block, err := aes.NewCipher(keys.Enc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	cipherText := packet[:plainSizeV2]
+	cipher.NewCTR(block, iv).XORKeyStream(cipherText, plainText)
+
+	mac := hmac.New(sha256.New, keys.MAC)
+	mac.Write(cipherText)
+	copy(packet[plainSizeV2:], mac.Sum(nil)[:macSizeV2])
+
+	return packet, nil
+}
+
+// decodeV2 authenticates and decrypts a v2 knock.
+func decodeV2(keys Keys, packet []byte) (*Knock, error) {
+	if len(packet) != PacketSizeV2 {
+		return nil, ErrShortPacket
+	}
+	cipherText := packet[:plainSizeV2]
+	tag := packet[plainSizeV2 : plainSizeV2+macSizeV2]
+	iv := packet[plainSizeV2+macSizeV2:]
+
+	mac := hmac.New(sha256.New, keys.MAC)
+	mac.Write(cipherText)
+	if !hmac.Equal(tag, mac.Sum(nil)[:macSizeV2]) {
+		return nil, ErrBadMAC
+	}
+
+	block, err := aes.NewCipher(keys.Enc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	plainText := make([]byte, plainSizeV2)
+	cipher.NewCTR(block, iv).XORKeyStream(plainText, cipherText)
+
+	if plainText[0] != Version2 {
+		return nil, ErrVersion
+	}
+
+	k := &Knock{
+		Version:   plainText[0],
+		Timestamp: time.Unix(int64(binary.BigEndian.Uint32(plainText[1:5])), 0),
+		AgentID:   binary.BigEndian.Uint64(plainText[5:13]),
+	}
+	copy(k.Nonce[:], plainText[13:])
+	return k, nil
+}
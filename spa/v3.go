@@ -0,0 +1,211 @@
+package spa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Header is the clear-text header of a v3 knock. It is authenticated but
+// must not be trusted before Decode succeeds.
+type Header struct {
+	Version byte
+	Suite   byte
+	Mode    byte
+	AgentID uint64 // ModeAgent and ModeSigned only
+	KeyID   uint32 // master key hint of ModeShared and ModeAgent, 0 for none
+
+	// ServerKeyID is the KeyID of the server key a ModeSealed or
+	// ModeHybrid envelope is encrypted to.
+	ServerKeyID uint64
+
+	ephemeral     []byte // ModeSealed and ModeHybrid only
+	kemCiphertext []byte // ModeHybrid only
+	iv            []byte // AEAD modes only
+	raw           []byte // the whole header, authenticated as associated data
+}
+
+// PeekHeader parses the clear-text header of a v3 knock, so the receiver
+// can pick the right keys before calling Decode.
+func PeekHeader(packet []byte) (*Header, error) {
+	h, _, err := parseHeaderV3(packet)
+	return h, err
+}
+
+// parseHeaderV3 splits a v3 packet into its header and the sealed or
+// signed body.
+func parseHeaderV3(packet []byte) (*Header, []byte, error) {
+	if len(packet) < 3 {
+		return nil, nil, ErrShortPacket
+	}
+	if packet[0] != Version3 {
+		return nil, nil, ErrVersion
+	}
+	h := &Header{Version: packet[0], Suite: packet[1], Mode: packet[2] &^ ModeFlagKeyID}
+	n := 3
+	switch h.Mode {
+	case ModeShared:
+	case ModeAgent, ModeSigned:
+		if len(packet) < n+8 {
+			return nil, nil, ErrShortPacket
+		}
+		h.AgentID = binary.BigEndian.Uint64(packet[n:])
+		n += 8
+	case ModeSealed:
+		if len(packet) < n+8+x25519KeySize {
+			return nil, nil, ErrShortPacket
+		}
+		h.ServerKeyID = binary.BigEndian.Uint64(packet[n:])
+		h.ephemeral = packet[n+8 : n+8+x25519KeySize]
+		n += 8 + x25519KeySize
+	case ModeHybrid:
+		if len(packet) < n+8+x25519KeySize+mlkem.CiphertextSize768 {
+			return nil, nil, ErrShortPacket
+		}
+		h.ServerKeyID = binary.BigEndian.Uint64(packet[n:])
+		h.ephemeral = packet[n+8 : n+8+x25519KeySize]
+		n += 8 + x25519KeySize
+		h.kemCiphertext = packet[n : n+mlkem.CiphertextSize768]
+		n += mlkem.CiphertextSize768
+	default:
+		return nil, nil, ErrMode
+	}
+
+	if packet[2]&ModeFlagKeyID != 0 {
+		if h.Mode != ModeShared && h.Mode != ModeAgent {
+			return nil, nil, ErrMode
+		}
+		if len(packet) < n+4 {
+			return nil, nil, ErrShortPacket
+		}
+		if h.KeyID = binary.BigEndian.Uint32(packet[n:]); h.KeyID == 0 {
+			return nil, nil, ErrMode
+		}
+		n += 4
+	}
+
+	if h.Mode == ModeSigned {
+		if h.Suite != SuiteNone {
+			return nil, nil, ErrSuite
+		}
+		if len(packet) < n+ed25519.SignatureSize {
+			return nil, nil, ErrShortPacket
+		}
+	} else {
+		if len(packet) < n+ivSizeV3+tagSizeV3 {
+			return nil, nil, ErrShortPacket
+		}
+		h.iv = packet[n : n+ivSizeV3]
+		n += ivSizeV3
+	}
+	h.raw = packet[:n]
+	return h, packet[n:], nil
+}
+
+// encodeV3 seals or signs k in the v3 format. ModeSealed and ModeHybrid
+// envelopes are built by Seal and SealHybrid instead.
+//
+// AEAD layout: Version(1) | Suite(1) | Mode(1) | [AgentID(8)] | [KeyID(4)] |
+// IV(12) | CipherText | Tag(16). AgentID is only present in ModeAgent, KeyID
+// only with ModeFlagKeyID. The header up to and including the IV is
+// authenticated as associated data.
+//
+// Signed layout: Version(1) | Suite(1)=0 | Mode(1)=2 | AgentID(8) | Body |
+// Signature(64). The Ed25519 signature covers everything before it; the
+// body is not encrypted.
+//
+// The body is the field list described in tlv.go.
+func encodeV3(keys Keys, k *Knock, random io.Reader) ([]byte, error) {
+	if k.KeyID != 0 && k.Mode != ModeShared && k.Mode != ModeAgent {
+		return nil, ErrMode
+	}
+	if k.Mode == ModeSigned {
+		return encodeSigned(keys, k)
+	}
+
+	aead, err := newAEAD(k.Suite, keys.AEAD)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte{Version3, k.Suite, k.Mode}
+	switch k.Mode {
+	case ModeShared:
+	case ModeAgent:
+		header = binary.BigEndian.AppendUint64(header, k.AgentID)
+	default:
+		return nil, ErrMode
+	}
+	if k.KeyID != 0 {
+		header[2] |= ModeFlagKeyID
+		header = binary.BigEndian.AppendUint32(header, k.KeyID)
+	}
+	header = append(header, make([]byte, ivSizeV3)...)
+	iv := header[len(header)-ivSizeV3:]
+	if _, err := io.ReadFull(random, iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+
+	plainText, err := encodeBody(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, iv, plainText, header), nil
+}
+
+// decodeV3 opens or verifies a v3 knock.
+func decodeV3(keys Keys, packet []byte) (*Knock, error) {
+	h, rest, err := parseHeaderV3(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	switch h.Mode {
+	case ModeSealed, ModeHybrid:
+		return nil, ErrMode // open with Unseal or UnsealHybrid first
+	case ModeSigned:
+		if body, err = verifySigned(keys, h, rest); err != nil {
+			return nil, err
+		}
+	default:
+		aead, err := newAEAD(h.Suite, keys.AEAD)
+		if err != nil {
+			return nil, err
+		}
+		if body, err = aead.Open(nil, h.iv, rest, h.raw); err != nil {
+			return nil, ErrBadMAC
+		}
+	}
+
+	k := &Knock{Version: Version3, Suite: h.Suite, Mode: h.Mode, KeyID: h.KeyID}
+	if err := decodeBody(k, body); err != nil {
+		return nil, err
+	}
+	if h.Mode != ModeShared && k.AgentID != h.AgentID {
+		return nil, ErrBadBody
+	}
+	return k, nil
+}
+
+func newAEAD(suite byte, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case SuiteAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %w", err)
+		}
+		return cipher.NewGCM(block)
+	case SuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, ErrSuite
+	}
+}